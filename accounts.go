@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var claimIPLimit = rateLimit{Limit: 5, Window: time.Minute * 15}
+var reauthLimit = rateLimit{Limit: 3, Window: time.Minute * 15}
+
+// =========================== Handlers ===================================
+
+// StartAccountClaim sends a link that lets a guest turn their temporary
+// account into a full one. The response does not reveal if the email exists
+func StartAccountClaim(w http.ResponseWriter, r *http.Request) {
+	if RateLimited(w, "claim:ip:"+ClientIP(r), claimIPLimit) {
+		return
+	}
+
+	request := struct {
+		Email string `json:"email"`
+	}{""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var user User
+	if db.Take(&user, "email = ? AND temporary = ?", strings.TrimSpace(request.Email), true).Error == nil {
+		SendClaimMail(user)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmAccountClaim sets a name and password for the guest. Orders
+// are linked by email, so the order history stays with the account
+func ConfirmAccountClaim(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Token          string `json:"token"`
+		Name           string `json:"name"`
+		Password       string `json:"password"`
+		RepeatPassword string `json:"repeatPassword"`
+	}{"", "", "", ""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	if len(request.Name) == 0 {
+		Response(w, http.StatusBadRequest, "vardas yra privalomas")
+		return
+	}
+
+	if err = NameTaken(request.Name, &User{}); err != nil {
+		Response(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	if err = CheckIfPasswordValid(request.Password, request.RepeatPassword); err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The token is only used up once the rest of the data is valid
+	verification, err := UseVerificationToken(request.Token, "claim")
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var user User
+	if err = db.Take(&user, "email = ? AND temporary = ?", verification.Email, true).Error; err != nil {
+		Response(w, http.StatusBadRequest, "paskyra jau aktyvuota")
+		return
+	}
+
+	user.Name = request.Name
+	user.Salt = GenerateSalt()
+	user.Password = GenerateSecurePassword(request.Password, user.Salt)
+	user.Temporary = false
+
+	if err = db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	accessToken, _ := MakeTokens(w, user)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(struct {
+		AccessToken string `json:"accessToken"`
+	}{accessToken}, w)
+}
+
+// GetMe returns the profile of the authorized user
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	var user User
+	email := GetClaim("email", r)
+	if err := db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	JSONResponse(NewProfile(user), w)
+}
+
+// StartReauthentication mails a short lived code to users without a
+// password. They use it instead of the current password to confirm
+// sensitive changes
+func StartReauthentication(w http.ResponseWriter, r *http.Request) {
+	var user User
+	email := GetClaim("email", r)
+	if err := db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !user.NoPassword {
+		Response(w, http.StatusBadRequest, "patvirtinkite dabartiniu slaptažodžiu")
+		return
+	}
+
+	if RateLimited(w, "reauth:account:"+user.ID, reauthLimit) {
+		return
+	}
+
+	token, err := CreateVerificationToken(user.Email, "reauth", "", time.Minute*15)
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	SendMail(user.Email, "Veiksmo patvirtinimas",
+		"Norėdami patvirtinti paskyros pakeitimus, įveskite šį kodą:\n"+token)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// UpdateMe changes the name, password or email of the authorized user.
+// Password and email changes require the current password, or the code
+// from StartReauthentication for users without one. New emails are only
+// applied once confirmed through ConfirmEmailChange
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"currentPassword"`
+		ReauthCode      string  `json:"reauthCode"`
+		Password        *string `json:"password"`
+		RepeatPassword  string  `json:"repeatPassword"`
+	}{nil, nil, "", "", nil, ""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var user User
+	email := GetClaim("email", r)
+	if err = db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if request.Email != nil && *request.Email == user.Email {
+		request.Email = nil
+	}
+
+	if (request.Password != nil || request.Email != nil) && !Reauthenticated(user, request.CurrentPassword, request.ReauthCode) {
+		Response(w, http.StatusForbidden, "neteisingas dabartinis slaptažodis")
+		return
+	}
+
+	claimsChanged := false
+
+	if request.Name != nil && *request.Name != user.Name {
+		if res, err := CheckUserName(*request.Name); err != nil {
+			Response(w, res, err.Error())
+			return
+		}
+
+		user.Name = *request.Name
+		claimsChanged = true
+	}
+
+	if request.Password != nil {
+		if err = CheckIfPasswordValid(*request.Password, request.RepeatPassword); err != nil {
+			Response(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		user.Password = GenerateSecurePassword(*request.Password, user.Salt)
+		user.NoPassword = false
+	}
+
+	if request.Email != nil {
+		if res, err := CheckUserEmail(*request.Email); err != nil {
+			Response(w, res, err.Error())
+			return
+		}
+	}
+
+	if err = db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	// Sessions opened with the old password stop working
+	if request.Password != nil {
+		db.Delete(&RefreshToken{}, "email = ?", user.Email)
+		claimsChanged = true
+
+		WriteAudit(r, "user.password_change", "user", user.ID)
+	}
+
+	if claimsChanged {
+		MakeTokens(w, user, HasSteppedUp(r))
+	}
+
+	profile := NewProfile(user)
+
+	if request.Email != nil {
+		SendEmailChangeMail(user, *request.Email)
+		profile.PendingEmail = request.Email
+	}
+
+	JSONResponse(profile, w)
+}
+
+// ConfirmEmailChange applies the new email. Orders are linked by email,
+// so they are moved to the new address together with the sessions
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Token string `json:"token"`
+	}{""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	email := GetClaim("email", r)
+
+	verification, err := UseVerificationToken(request.Token, "email")
+	if err != nil || email == nil || verification.Email != *email {
+		Response(w, http.StatusBadRequest, "nuoroda nebegalioja")
+		return
+	}
+
+	var user User
+	if err = db.Take(&user, "email = ?", verification.Email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if res, err := CheckUserEmail(verification.Payload); err != nil {
+		Response(w, res, err.Error())
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("email", verification.Payload).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&Order{}).Where("email = ?", verification.Email).Update("email", verification.Payload).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("email = ?", verification.Email).Delete(&RefreshToken{}).Error
+	})
+
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	user.Email = verification.Payload
+	WriteAuditAs(r, user.ID, "user.email_change", "user", user.ID)
+
+	MakeTokens(w, user, HasSteppedUp(r))
+	JSONResponse(NewProfile(user), w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+// ClaimMailAllowed counts a claim mail sent without a response against
+// StartAccountClaim's limit
+func ClaimMailAllowed(r *http.Request) bool {
+	count, _, err := rateLimitStore.Hit("claim:ip:"+ClientIP(r), claimIPLimit.Window)
+	return err == nil && count <= claimIPLimit.Limit
+}
+
+func SendClaimMail(user User) {
+	token, err := CreateVerificationToken(user.Email, "claim", "", time.Hour*24)
+	if err != nil {
+		return
+	}
+
+	SendMail(user.Email, "Paskyros sukūrimas",
+		"Norėdami susikurti paskyrą ir išsaugoti užsakymų istoriją, paspauskite nuorodą:\n"+
+			FrontendLink("/claim?token="+token))
+}
+
+// CreateVerificationToken returns a single use token sent by email.
+// Only its hash is stored
+func CreateVerificationToken(email string, purpose string, payload string, ttl time.Duration) (string, error) {
+	token := RandomString()
+
+	err := db.Create(&VerificationToken{
+		Email:     email,
+		Purpose:   purpose,
+		Hash:      HashApiKey(token),
+		Payload:   payload,
+		ExpiresAt: time.Now().Add(ttl),
+	}).Error
+
+	return token, err
+}
+
+func UseVerificationToken(token string, purpose string) (VerificationToken, error) {
+	var verification VerificationToken
+
+	err := db.Take(&verification, "hash = ? AND purpose = ?", HashApiKey(token), purpose).Error
+	if err != nil || verification.UsedAt != nil || verification.ExpiresAt.Before(time.Now()) {
+		return verification, errors.New("nuoroda nebegalioja")
+	}
+
+	result := db.Model(&VerificationToken{}).Where("id = ? AND used_at IS NULL", verification.ID).Update("used_at", time.Now())
+	if result.RowsAffected == 0 {
+		return verification, errors.New("nuoroda nebegalioja")
+	}
+
+	return verification, nil
+}
+
+type Profile struct {
+	Name             string  `json:"name"`
+	Email            string  `json:"email"`
+	PendingEmail     *string `json:"pendingEmail,omitempty"`
+	Permissions      string  `json:"permissions"`
+	Shop             *string `json:"shop"`
+	TwoFactorEnabled bool    `json:"twoFactorEnabled"`
+	HasPassword      bool    `json:"hasPassword"`
+
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt"`
+}
+
+func NewProfile(user User) Profile {
+	return Profile{
+		Name:             user.Name,
+		Email:            user.Email,
+		Permissions:      user.Permissions,
+		Shop:             user.ShopCodename,
+		TwoFactorEnabled: user.TwoFactorEnabled,
+		HasPassword:      !user.NoPassword,
+
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	}
+}
+
+// Reauthenticated checks the current password, or the reauth code for
+// users without a password
+func Reauthenticated(user User, password string, code string) bool {
+	if !user.NoPassword {
+		return GenerateSecurePassword(password, user.Salt) == user.Password
+	}
+
+	verification, err := UseVerificationToken(code, "reauth")
+	return err == nil && verification.Email == user.Email
+}
+
+func SendEmailChangeMail(user User, newEmail string) {
+	token, err := CreateVerificationToken(user.Email, "email", newEmail, time.Hour*24)
+	if err != nil {
+		return
+	}
+
+	SendMail(newEmail, "El.pašto patvirtinimas",
+		"Norėdami patvirtinti naują el.pašto adresą, paspauskite nuorodą:\n"+
+			FrontendLink("/me/email?token="+token))
+}
+
+func IsTemporaryEmail(email string) bool {
+	return db.Take(&User{}, "email = ? AND temporary = ?", email, true).Error == nil
+}
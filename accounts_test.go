@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestClaimAccount(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	guest := User{Email: "testClaimGuest@email.com", Temporary: true}
+	app.DB.Create(&guest)
+
+	token, _ := CreateVerificationToken(guest.Email, "claim", "", time.Hour)
+	expiredToken, _ := CreateVerificationToken(guest.Email, "claim", "", -time.Hour)
+
+	t.Cleanup(func() {
+		app.DB.Unscoped().Delete(&User{}, "email = ?", guest.Email)
+		app.DB.Delete(&RefreshToken{}, "email = ?", guest.Email)
+		app.DB.Delete(&VerificationToken{}, "email = ?", guest.Email)
+		app.CloseDbTest()
+	})
+
+	cases := []TestStruct{
+		{
+			name:     "ExpiredToken",
+			body:     map[string]interface{}{"token": expiredToken, "name": "testClaimUser", "password": "password123", "repeatPassword": "password123"},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "PasswordsDontMatch",
+			body:     map[string]interface{}{"token": token, "name": "testClaimUser", "password": "password123", "repeatPassword": "123password"},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "ClaimSuccess",
+			body:     map[string]interface{}{"token": token, "name": "testClaimUser", "password": "password123", "repeatPassword": "password123"},
+			expected: http.StatusCreated,
+		},
+		{
+			name:     "TokenIsSingleUse",
+			body:     map[string]interface{}{"token": token, "name": "testClaimUser2", "password": "password123", "repeatPassword": "password123"},
+			expected: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, _ := json.Marshal(c.body)
+
+			apitest.New(c.name).
+				Handler(app.Router).
+				Post("/claim/confirm").JSON(body).
+				Expect(t).
+				Status(c.expected).
+				End()
+		})
+	}
+}
+
+func TestUpdateMe(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	_, buyerToken, _ := InitAccount(app, "buyer")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	cases := []TestStruct{
+		{
+			name:     "UnauthorizedNoToken",
+			body:     map[string]interface{}{"name": "buyer"},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:        "PasswordChangeNeedsCurrentPassword",
+			body:        map[string]interface{}{"password": "password123", "repeatPassword": "password123"},
+			accessToken: &buyerToken,
+			expected:    http.StatusForbidden,
+		},
+		{
+			name:        "NameTaken",
+			body:        map[string]interface{}{"name": "seller"},
+			accessToken: &buyerToken,
+			expected:    http.StatusConflict,
+		},
+		{
+			name:        "SameNameIsNotAChange",
+			body:        map[string]interface{}{"name": "buyer"},
+			accessToken: &buyerToken,
+			expected:    http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, _ := json.Marshal(c.body)
+
+			test := apitest.New(c.name).
+				Handler(app.Router).
+				Put("/me").JSON(body)
+
+			if c.accessToken != nil {
+				test.Cookie("Access-Token", *c.accessToken)
+			}
+
+			test.Expect(t).Status(c.expected).End()
+		})
+	}
+}
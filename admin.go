@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type AdminUser struct {
+	ID               string     `json:"id"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	Permissions      string     `json:"permissions"`
+	Temporary        bool       `json:"temporary"`
+	Shop             *string    `json:"shop"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	SuspendedAt      *time.Time `json:"suspendedAt"`
+	LockedUntil      *time.Time `json:"lockedUntil"`
+}
+
+type AdminUserDetails struct {
+	AdminUser
+	ShopDetails     *Shop `json:"shopDetails"`
+	OrderCount      int64 `json:"orderCount"`
+	ShopOrderCount  int64 `json:"shopOrderCount"`
+	ActiveSessions  int64 `json:"activeSessions"`
+	DeletionPending bool  `json:"deletionPending"`
+}
+
+// =========================== Handlers ===================================
+
+var userList = listDefinition{
+	Table: "users",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+		"name":      {Column: "name", Field: "Name"},
+		"email":     {Column: "email", Field: "Email"},
+	},
+	DefaultSort: "-createdAt",
+}
+
+// GetUsers lists users for admins page by page. Supports search by name
+// or email (q), role (a, f, c) and temporary=true|false
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	params, err := ParseListParams(r, userList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	role := strings.ToLower(query.Get("role"))
+	if len(role) > 0 && role != "a" && role != "f" && role != "c" {
+		Response(w, http.StatusBadRequest, "tokia rolė neegzistuoja")
+		return
+	}
+
+	filters := func(tx *gorm.DB) *gorm.DB {
+		if search := strings.TrimSpace(query.Get("q")); len(search) > 0 {
+			pattern := "%" + strings.ToLower(search) + "%"
+			tx.Where("LOWER(users.name) LIKE ? OR LOWER(users.email) LIKE ?", pattern, pattern)
+		}
+
+		if len(role) > 0 {
+			tx.Where("LOWER(users.permissions) LIKE ?", "%"+role+"%")
+		}
+
+		if temporary := query.Get("temporary"); len(temporary) > 0 {
+			tx.Where("users.temporary = ?", temporary == "true")
+		}
+
+		return tx
+	}
+
+	users := make([]User, 0)
+	page, err := Paginate(db, &User{}, filters, params, &users)
+
+	items := make([]AdminUser, 0, len(users))
+	for _, user := range users {
+		items = append(items, NewAdminUser(user))
+	}
+
+	page.Items = items
+	PageResponse(w, page, err)
+}
+
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := FindUserByParam(r)
+	if err != nil {
+		Response(w, http.StatusNotFound, "vartotojas nerastas")
+		return
+	}
+
+	details := AdminUserDetails{
+		AdminUser:       NewAdminUser(user),
+		DeletionPending: user.DeletionScheduledAt != nil,
+	}
+
+	var shop Shop
+	if db.Preload("Locations").Take(&shop, "user_id = ?", user.ID).Error == nil {
+		details.ShopDetails = &shop
+		db.Model(&ShopOrder{}).Where("shop_id = ?", shop.ID).Count(&details.ShopOrderCount)
+	}
+
+	db.Model(&Order{}).Where("email = ?", user.Email).Count(&details.OrderCount)
+	db.Model(&RefreshToken{}).Where("email = ?", user.Email).Count(&details.ActiveSessions)
+
+	JSONResponse(details, w)
+}
+
+// SuspendUser blocks login and token refresh. Open sessions end
+// when their access token expires
+func SuspendUser(w http.ResponseWriter, r *http.Request) {
+	SetUserSuspended(w, r, true)
+}
+
+func UnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	SetUserSuspended(w, r, false)
+}
+
+// ForcePasswordReset invalidates the current password and sessions,
+// the user sets a new password through the emailed link
+func ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, err := FindUserByParam(r)
+	if err != nil || user.Temporary {
+		Response(w, http.StatusNotFound, "vartotojas nerastas")
+		return
+	}
+
+	user.Password = GenerateSecurePassword(RandomString(), user.Salt)
+	if err = db.Model(&user).Update("password", user.Password).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	db.Delete(&RefreshToken{}, "email = ?", user.Email)
+	SendPasswordResetMail(user)
+
+	WriteAudit(r, "user.password_reset", "user", user.ID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmPasswordReset sets a new password with a token from SendPasswordResetMail
+func ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Token          string `json:"token"`
+		Password       string `json:"password"`
+		RepeatPassword string `json:"repeatPassword"`
+	}{"", "", ""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	if err = CheckIfPasswordValid(request.Password, request.RepeatPassword); err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	verification, err := UseVerificationToken(request.Token, "reset")
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var user User
+	if err = db.Take(&user, "email = ? AND temporary = ?", verification.Email, false).Error; err != nil {
+		Response(w, http.StatusBadRequest, "nuoroda nebegalioja")
+		return
+	}
+
+	user.Password = GenerateSecurePassword(request.Password, user.Salt)
+	user.NoPassword = false
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+
+	if err = db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	WriteAuditAs(r, user.ID, "user.password_change", "user", user.ID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func PromoteToCourier(w http.ResponseWriter, r *http.Request) {
+	user, err := FindUserByParam(r)
+	if err != nil || user.Temporary {
+		Response(w, http.StatusNotFound, "vartotojas nerastas")
+		return
+	}
+
+	if HasCourierPermissions(user.Permissions) {
+		JSONResponse(NewAdminUser(user), w)
+		return
+	}
+
+	user.Permissions += "c"
+	if err = db.Model(&user).Update("permissions", user.Permissions).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	WriteAudit(r, "user.promote_courier", "user", user.ID)
+	JSONResponse(NewAdminUser(user), w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func NewAdminUser(user User) AdminUser {
+	return AdminUser{
+		ID:               user.ID,
+		CreatedAt:        user.CreatedAt,
+		Name:             user.Name,
+		Email:            user.Email,
+		Permissions:      user.Permissions,
+		Temporary:        user.Temporary,
+		Shop:             user.ShopCodename,
+		TwoFactorEnabled: user.TwoFactorEnabled,
+		SuspendedAt:      user.SuspendedAt,
+		LockedUntil:      user.LockedUntil,
+	}
+}
+
+func FindUserByParam(r *http.Request) (User, error) {
+	params := mux.Vars(r)
+
+	var user User
+	err := db.Take(&user, "id = ?", params["id"]).Error
+	return user, err
+}
+
+func SetUserSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	user, err := FindUserByParam(r)
+	if err != nil {
+		Response(w, http.StatusNotFound, "vartotojas nerastas")
+		return
+	}
+
+	action := "user.unsuspend"
+	user.SuspendedAt = nil
+
+	if suspended {
+		action = "user.suspend"
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+
+	if err = db.Model(&user).Update("suspended_at", user.SuspendedAt).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	if suspended {
+		db.Delete(&RefreshToken{}, "email = ?", user.Email)
+	}
+
+	WriteAudit(r, action, "user", user.ID)
+	JSONResponse(NewAdminUser(user), w)
+}
+
+func SendPasswordResetMail(user User) {
+	token, err := CreateVerificationToken(user.Email, "reset", "", time.Hour*24)
+	if err != nil {
+		return
+	}
+
+	SendMail(user.Email, "Slaptažodžio keitimas",
+		"Jūsų slaptažodis buvo atstatytas. Naują slaptažodį galite nustatyti paspaudę nuorodą:\n"+
+			FrontendLink("/password-reset?token="+token))
+}
+
+func IsSuspended(user User) bool {
+	return user.SuspendedAt != nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+)
+
+func TestGetUsers(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	_, adminToken, _ := InitAccount(app, "admin")
+	_, buyerToken, _ := InitAccount(app, "buyer")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	cases := []struct {
+		TestStruct
+		query map[string]string
+	}{
+		{
+			TestStruct: TestStruct{name: "UnauthorizedNotAdmin", accessToken: &buyerToken, expected: http.StatusUnauthorized},
+		},
+		{
+			TestStruct: TestStruct{name: "UnknownRole", accessToken: &adminToken, expected: http.StatusBadRequest},
+			query:      map[string]string{"role": "x"},
+		},
+		{
+			TestStruct: TestStruct{
+				name:        "SearchByName",
+				accessToken: &adminToken,
+				response:    jsonpath.Chain().Equal("items[0].name", "courier").Equal("limit", float64(5)),
+				expected:    http.StatusOK,
+			},
+			query: map[string]string{"q": "courier", "role": "c", "limit": "5"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := apitest.New(c.name).
+				Handler(app.Router).
+				Get("/admin/users").
+				QueryParams(c.query)
+
+			if c.accessToken != nil {
+				test.Cookie("Access-Token", *c.accessToken)
+			}
+
+			response := test.Expect(t).Status(c.expected)
+
+			if c.response != nil {
+				response.Assert(c.response.End())
+			}
+
+			response.End()
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// API keys look like "mga_<prefix>_<secret>". The prefix is stored in
+// plain text to find the key, only a hash of the whole key is kept
+const apiKeyPrefix = "mga_"
+
+var errApiKeyOwnerSuspended = errors.New("api key owner is suspended")
+
+var apiKeyScopes = map[string]bool{
+	"products:write": true,
+	"products:read":  true,
+	"orders:read":    true,
+}
+
+// =========================== Handlers ===================================
+
+func GetApiKeys(w http.ResponseWriter, r *http.Request) {
+	email := GetClaim("email", r)
+
+	var shop Shop
+	if err := GetShopByEmail(*email, &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "jūs neturite parduotuvės")
+		return
+	}
+
+	keys := make([]ApiKey, 0)
+	db.Where("shop_id = ?", shop.ID).Order("created_at desc").Find(&keys)
+	JSONResponse(keys, w)
+}
+
+func CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	email := GetClaim("email", r)
+
+	var shop Shop
+	if err := GetShopByEmail(*email, &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "jūs neturite parduotuvės")
+		return
+	}
+
+	request := struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}{"", nil, nil}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) == 0 {
+		Response(w, http.StatusBadRequest, "vardas yra privalomas")
+		return
+	}
+
+	if len(request.Scopes) == 0 {
+		Response(w, http.StatusBadRequest, "teisės yra privalomos")
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		if !apiKeyScopes[scope] {
+			Response(w, http.StatusBadRequest, "tokia teisė neegzistuoja", scope)
+			return
+		}
+	}
+
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		Response(w, http.StatusBadRequest, "galiojimo laikas turi būti ateityje")
+		return
+	}
+
+	key, prefix := GenerateApiKey()
+
+	apiKey := ApiKey{
+		Name:      request.Name,
+		Prefix:    prefix,
+		Hash:      HashApiKey(key),
+		Scopes:    strings.Join(request.Scopes, ","),
+		ExpiresAt: request.ExpiresAt,
+		SteppedUp: HasSteppedUp(r),
+		ShopID:    shop.ID,
+	}
+
+	if err = db.Create(&apiKey).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	WriteAuditChange(r, "api_key.create", "api_key", apiKey.ID, nil, apiKey)
+
+	// The key is only ever shown in this response
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(struct {
+		ApiKey
+		Key string `json:"key"`
+	}{apiKey, key}, w)
+}
+
+func DeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	email := GetClaim("email", r)
+
+	var shop Shop
+	if err := GetShopByEmail(*email, &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "jūs neturite parduotuvės")
+		return
+	}
+
+	params := mux.Vars(r)
+
+	result := db.Where("id = ? AND shop_id = ?", params["id"], shop.ID).Delete(&ApiKey{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		Response(w, http.StatusBadRequest, "raktas nerastas")
+		return
+	}
+
+	WriteAudit(r, "api_key.delete", "api_key", params["id"])
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func GenerateApiKey() (key string, prefix string) {
+	random := make([]byte, 36)
+	rand.Read(random)
+
+	encoded := hex.EncodeToString(random)
+	prefix = encoded[0:8]
+
+	return apiKeyPrefix + prefix + "_" + encoded[8:], prefix
+}
+
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateApiKey finds the key and builds claims that look like
+// the shop owner's token, limited to the key's scopes. The key stops
+// working once its owner is suspended, no longer a farmer or is being deleted
+func AuthenticateApiKey(key string) (jwt.MapClaims, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, jwt.NewValidationError("malformed api key", jwt.ValidationErrorMalformed)
+	}
+
+	var apiKey ApiKey
+	err := db.Preload("Shop").Preload("Shop.User").Take(&apiKey, "prefix = ?", parts[0]).Error
+	if err != nil || subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(HashApiKey(key))) != 1 {
+		return nil, jwt.NewValidationError("invalid api key", jwt.ValidationErrorSignatureInvalid)
+	}
+
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+		return nil, jwt.NewValidationError("api key expired", jwt.ValidationErrorExpired)
+	}
+
+	owner := apiKey.Shop.User
+	if IsSuspended(owner) {
+		return nil, errApiKeyOwnerSuspended
+	}
+
+	if len(owner.ID) == 0 || owner.DeletionScheduledAt != nil || !HasFarmerPermissions(owner.Permissions) {
+		return nil, jwt.NewValidationError("api key owner can not use it", jwt.ValidationErrorClaimsInvalid)
+	}
+
+	db.Model(&apiKey).Update("last_used_at", time.Now())
+
+	return jwt.MapClaims{
+		"name":        owner.Name,
+		"email":       owner.Email,
+		"permissions": owner.Permissions,
+		"shop":        apiKey.Shop.Codename,
+		"mfa":         apiKey.SteppedUp && owner.TwoFactorEnabled, // Only keys created after proving a second factor
+		"apiKey":      apiKey.ID,
+		"scopes":      apiKey.Scopes,
+	}, nil
+}
+
+func HasScope(r *http.Request, scope string) bool {
+	scopes := GetClaim("scopes", r)
+	if scopes == nil {
+		return false
+	}
+
+	for _, s := range strings.Split(*scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAuthorizedWithKey works like isAuthorized, but also accepts
+// API keys that were granted the given scope
+func isAuthorizedWithKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if len(key) == 0 {
+			key, _ = GetAccessToken(r)
+		}
+
+		if !strings.HasPrefix(key, apiKeyPrefix) {
+			isAuthorized(next).ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := AuthenticateApiKey(key)
+		if err == errApiKeyOwnerSuspended {
+			Response(w, http.StatusForbidden, "paskyra sustabdyta")
+			return
+		}
+
+		if err != nil {
+			Unauthorized(w, "invalid_token", err.Error())
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxKey{}, claims)
+		r = r.WithContext(ctx)
+
+		if !HasScope(r, scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="miniGoApi", error="insufficient_scope", scope="`+scope+`"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
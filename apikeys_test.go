@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+)
+
+func CreateTempApiKey(shopCodename string, scopes string) string {
+	var shop Shop
+	db.Take(&shop, "codename = ?", shopCodename)
+
+	key, prefix := GenerateApiKey()
+	db.Create(&ApiKey{Name: "testApiKey", Prefix: prefix, Hash: HashApiKey(key), Scopes: scopes, ShopID: shop.ID})
+
+	return key
+}
+
+func TestCreateApiKey(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	_, sellerToken, _ := InitAccount(app, "seller")
+	_, buyerToken, _ := InitAccount(app, "buyer")
+
+	t.Cleanup(func() {
+		app.DB.Delete(&ApiKey{}, "name ~ ?", "testApiKey")
+		app.CloseDbTest()
+	})
+
+	cases := []TestStruct{
+		{
+			name:        "UnauthorizedNotFarmer",
+			body:        map[string]interface{}{"name": "testApiKey1", "scopes": []string{"orders:read"}},
+			accessToken: &buyerToken,
+			expected:    http.StatusUnauthorized,
+		},
+		{
+			name:        "UnknownScope",
+			body:        map[string]interface{}{"name": "testApiKey2", "scopes": []string{"orders:write"}},
+			accessToken: &sellerToken,
+			expected:    http.StatusBadRequest,
+		},
+		{
+			name:        "NameRequired",
+			body:        map[string]interface{}{"scopes": []string{"orders:read"}},
+			accessToken: &sellerToken,
+			expected:    http.StatusBadRequest,
+		},
+		{
+			name:        "SuccessCreate",
+			body:        map[string]interface{}{"name": "testApiKey3", "scopes": []string{"orders:read"}},
+			accessToken: &sellerToken,
+			response:    jsonpath.Chain().Equal("name", "testApiKey3").Present("key"),
+			expected:    http.StatusCreated,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, _ := json.Marshal(c.body)
+
+			test := apitest.New(c.name).
+				Handler(app.Router).
+				Post("/shop/keys").JSON(body)
+
+			if c.accessToken != nil {
+				test.Cookie("Access-Token", *c.accessToken)
+			}
+
+			response := test.Expect(t).Status(c.expected)
+
+			if c.response != nil {
+				response.Assert(c.response.End())
+			}
+
+			response.End()
+		})
+	}
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	readKey := CreateTempApiKey("seller_shop", "orders:read")
+	writeKey := CreateTempApiKey("seller_shop", "products:write")
+	invalidKey := apiKeyPrefix + "00000000_00"
+
+	t.Cleanup(func() {
+		app.DB.Delete(&ApiKey{}, "name ~ ?", "testApiKey")
+		app.CloseDbTest()
+	})
+
+	cases := []TestStruct{
+		{
+			name:        "OrdersWithReadScope",
+			accessToken: &readKey,
+			expected:    http.StatusOK,
+		},
+		{
+			name:        "OrdersWithoutScope",
+			accessToken: &writeKey,
+			expected:    http.StatusForbidden,
+		},
+		{
+			name:        "InvalidKey",
+			accessToken: &invalidKey,
+			expected:    http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			apitest.New(c.name).
+				Handler(app.Router).
+				Get("/shop/orders").
+				Header("X-Api-Key", *c.accessToken).
+				Expect(t).
+				Status(c.expected).
+				End()
+		})
+	}
+}
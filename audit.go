@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditChanges maps changed field names to their old and new values
+type AuditChanges map[string]AuditChange
+
+// Audit events can only be inserted, the trigger makes sure nobody
+// rewrites history directly in the database either
+const auditAppendOnlySQL = `
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+`
+
+// =========================== Handlers ===================================
+
+var auditList = listDefinition{
+	Table: "audit_events",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+	},
+	DefaultSort: "-createdAt",
+}
+
+// GetAuditEvents lists audit events for admins page by page, newest
+// first. Filters: actor, action, entityType, entityId, from and to
+// (2006-01-02)
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	params, err := ParseListParams(r, auditList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	createdFilter, err := DateRangeFilter(r, "audit_events.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	columns := map[string]string{
+		"actor":      "audit_events.actor_id = ?",
+		"action":     "audit_events.action = ?",
+		"entityType": "audit_events.entity_type = ?",
+		"entityId":   "audit_events.entity_id = ?",
+	}
+
+	filters := func(tx *gorm.DB) *gorm.DB {
+		for param, statement := range columns {
+			if value := query.Get(param); len(value) > 0 {
+				tx.Where(statement, value)
+			}
+		}
+
+		return createdFilter(tx)
+	}
+
+	events := make([]AuditEvent, 0)
+	page, err := Paginate(db, &AuditEvent{}, filters, params, &events)
+	PageResponse(w, page, err)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+// WriteAudit records an action done by the currently authorized user
+func WriteAudit(r *http.Request, action string, entityType string, entityID string) {
+	WriteAuditChange(r, action, entityType, entityID, nil, nil)
+}
+
+// WriteAuditChange records an action together with the fields that
+// differ between before and after. Either of them can be nil
+func WriteAuditChange(r *http.Request, action string, entityType string, entityID string, before interface{}, after interface{}) {
+	db.Create(&AuditEvent{
+		ActorID:    RequestActorID(r),
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Changes:    AuditDiff(before, after),
+		IP:         ClientIP(r),
+	})
+}
+
+// WriteAuditAs records an action for a known actor, e.g. during login
+// when there are no claims yet
+func WriteAuditAs(r *http.Request, actorID string, action string, entityType string, entityID string) {
+	db.Create(&AuditEvent{
+		ActorID:    actorID,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		IP:         ClientIP(r),
+	})
+}
+
+// AuditDiff compares the plain fields of two structs of the same type.
+// Associations and secrets (Password, Salt, TwoFactorSecret) are skipped
+func AuditDiff(before interface{}, after interface{}) AuditChanges {
+	if before == nil && after == nil {
+		return nil
+	}
+
+	beforeFields := AuditFields(before)
+	afterFields := AuditFields(after)
+
+	changes := make(AuditChanges)
+
+	for name, value := range afterFields {
+		if !reflect.DeepEqual(beforeFields[name], value) {
+			changes[name] = AuditChange{Before: beforeFields[name], After: value}
+		}
+	}
+
+	for name, value := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			changes[name] = AuditChange{Before: value}
+		}
+	}
+
+	return changes
+}
+
+var auditSkippedFields = map[string]bool{
+	"Password":        true,
+	"Salt":            true,
+	"TwoFactorSecret": true,
+	"CreatedAt":       true,
+	"DeletedAt":       true,
+}
+
+// AuditFields takes a snapshot of the fields AuditDiff compares. Take it
+// before changing a model, pointer fields would otherwise change with it
+func AuditFields(model interface{}) map[string]interface{} {
+	if snapshot, ok := model.(map[string]interface{}); ok {
+		return snapshot
+	}
+
+	fields := make(map[string]interface{})
+
+	value := reflect.ValueOf(model)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return fields
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return fields
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		// Fields that are not stored, e.g. Product.Availability, are computed
+		if field.PkgPath != "" || auditSkippedFields[field.Name] || field.Tag.Get("gorm") == "-" {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				fields[field.Name] = nil
+				continue
+			}
+			fieldValue = fieldValue.Elem()
+		}
+
+		switch typed := fieldValue.Interface().(type) {
+		case time.Time:
+			fields[field.Name] = typed.Format(time.RFC3339)
+		case decimal.Decimal:
+			fields[field.Name] = typed.String()
+		case ImagePath:
+			fields[field.Name] = string(typed)
+		default:
+			switch fieldValue.Kind() {
+			case reflect.Struct, reflect.Slice, reflect.Map:
+				continue
+			}
+
+			fields[field.Name] = typed
+		}
+	}
+
+	return fields
+}
+
+func (c AuditChanges) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(c)
+	return string(encoded), err
+}
+
+func (c *AuditChanges) Scan(value interface{}) error {
+	switch typed := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(typed, c)
+	case string:
+		return json.Unmarshal([]byte(typed), c)
+	}
+
+	return errors.New("unsupported audit changes type")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+)
+
+func TestAuditDiff(t *testing.T) {
+	name := "Obuoliai"
+	renamed := "Kriaušės"
+
+	before := AuditFields(Product{Name: &name, Price: decimal.NewFromInt(2), Quantity: decimal.NewFromInt(5)})
+	name = renamed
+
+	changes := AuditDiff(before, Product{Name: &name, Price: decimal.NewFromInt(2), Quantity: decimal.NewFromInt(3)})
+
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+
+	if changes["Name"].Before != "Obuoliai" || changes["Name"].After != renamed {
+		t.Errorf("unexpected name change %v", changes["Name"])
+	}
+
+	if changes["Quantity"].Before != "5" || changes["Quantity"].After != "3" {
+		t.Errorf("unexpected quantity change %v", changes["Quantity"])
+	}
+
+	if _, ok := AuditDiff(nil, User{Password: "secret"})["Password"]; ok {
+		t.Error("password must not be audited")
+	}
+}
+
+func TestGetAuditEvents(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	admin, adminToken, _ := InitAccount(app, "admin")
+	_, buyerToken, _ := InitAccount(app, "buyer")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	app.DB.Create(&AuditEvent{ActorID: admin.ID, Action: "test.audit", EntityType: "test", EntityID: "1"})
+
+	cases := []struct {
+		TestStruct
+		query map[string]string
+	}{
+		{
+			TestStruct: TestStruct{name: "UnauthorizedNotAdmin", accessToken: &buyerToken, expected: http.StatusUnauthorized},
+		},
+		{
+			TestStruct: TestStruct{name: "BadDate", accessToken: &adminToken, expected: http.StatusBadRequest},
+			query:      map[string]string{"from": "vakar"},
+		},
+		{
+			TestStruct: TestStruct{
+				name:        "FilterByAction",
+				accessToken: &adminToken,
+				response:    jsonpath.Chain().Equal("items[0].action", "test.audit").Equal("items[0].actorId", admin.ID),
+				expected:    http.StatusOK,
+			},
+			query: map[string]string{"action": "test.audit", "actor": admin.ID},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := apitest.New(c.name).
+				Handler(app.Router).
+				Get("/admin/audit").
+				QueryParams(c.query)
+
+			if c.accessToken != nil {
+				test.Cookie("Access-Token", *c.accessToken)
+			}
+
+			response := test.Expect(t).Status(c.expected)
+
+			if c.response != nil {
+				response.Assert(c.response.End())
+			}
+
+			response.End()
+		})
+	}
+
+	if app.DB.Model(&AuditEvent{}).Where("action = ?", "test.audit").Update("action", "changed").Error == nil {
+		t.Error("audit events must be append-only")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -18,6 +19,8 @@ import (
 
 type permissionValidator func(string) bool
 
+const refreshTokenLifetime = time.Hour * 24 * 7
+
 // =========================== Handlers ===================================
 func Login(w http.ResponseWriter, r *http.Request) {
 	errorMSG := "blogi duomenys"
@@ -29,6 +32,10 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	json.NewDecoder(r.Body).Decode(&requestData)
 
+	if RateLimited(w, "login:ip:"+ClientIP(r), loginIPLimit) || RateLimited(w, "login:account:"+requestData.Name, loginAccountLimit) {
+		return
+	}
+
 	var userDatabaseData User
 
 	// Finds user by email in database, if no user, then returns "bad request"
@@ -38,17 +45,43 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if IsLocked(userDatabaseData) {
+		TooManyRequests(w, *userDatabaseData.LockedUntil, "paskyra laikinai užrakinta. bandykite vėliau")
+		return
+	}
+
 	hashedPassword := GenerateSecurePassword(requestData.Password, userDatabaseData.Salt)
 	//checks if salted hashed password from database matches the sent in salted hashed password
 	if hashedPassword != userDatabaseData.Password {
+		RegisterFailedLogin(r, userDatabaseData)
 		Response(w, http.StatusBadRequest, errorMSG)
 		return
 	}
+
+	if IsSuspended(userDatabaseData) {
+		Response(w, http.StatusForbidden, "paskyra sustabdyta")
+		return
+	}
+
+	// Password is correct, but the user still has to enter a TOTP code
+	if userDatabaseData.TwoFactorEnabled {
+		challenge, _ := GenerateChallengeToken(userDatabaseData)
+
+		JSONResponse(struct {
+			TwoFactorRequired bool   `json:"twoFactorRequired"`
+			Challenge         string `json:"challenge"`
+		}{true, challenge}, w)
+		return
+	}
+
+	// With two factor authentication the login only succeeds in LoginTwoFactor
+	RegisterSuccessfulLogin(r, userDatabaseData)
+
 	accessToken, _ := MakeTokens(w, userDatabaseData)
 
 	w.WriteHeader(http.StatusAccepted)
 	JSONResponse(struct {
-		AccessToken string `json:accessToken`
+		AccessToken string `json:"accessToken"`
 	}{accessToken}, w)
 }
 
@@ -64,6 +97,10 @@ func CheckEmail(w http.ResponseWriter, r *http.Request) {
 		Email string `json:"email"`
 	}{""}
 
+	if RateLimited(w, "checkmail:ip:"+ClientIP(r), checkEmailIPLimit) {
+		return
+	}
+
 	err := json.NewDecoder(r.Body).Decode(&request)
 
 	if err != nil {
@@ -100,6 +137,13 @@ func CreateAccount(w http.ResponseWriter, r *http.Request) {
 	res, err := PerformUserDataChecks(requestData.Name, requestData.Email, requestData.Password, requestData.RepeatPassword)
 
 	if err != nil {
+		// The email was used for guest orders, its owner gets a mail to
+		// claim it. The response stays the same as for any taken email
+		var guest User
+		if res == http.StatusConflict && db.Take(&guest, "email = ? AND temporary = ?", requestData.Email, true).Error == nil && ClaimMailAllowed(r) {
+			SendClaimMail(guest)
+		}
+
 		Response(w, res, err.Error())
 		return
 	}
@@ -129,7 +173,7 @@ func CreateAccount(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusCreated)
 	JSONResponse(struct {
-		AccessToken string `json:accessToken`
+		AccessToken string `json:"accessToken"`
 	}{accessToken}, w)
 }
 
@@ -138,12 +182,7 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 
 	if err == nil {
 		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(refreshTokenCookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("įvyko klaida. bandykite dar kartą")
-			}
-			return signKey, nil
-		})
+		token, err := ParseToken(refreshTokenCookie.Value, claims)
 
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -155,6 +194,11 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if claims["purpose"] != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
 		email := fmt.Sprintf("%v", claims["email"])
 
 		var oldRefreshToken RefreshToken
@@ -177,11 +221,17 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 		var user User
 		db.Take(&user, "email = ?", email)
 
-		accessToken, _ := MakeTokens(w, user)
+		if IsSuspended(user) {
+			Response(w, http.StatusForbidden, "paskyra sustabdyta")
+			return
+		}
+
+		// Keep the step-up for the lifetime of the refresh token
+		accessToken, _ := MakeTokens(w, user, claims["mfa"] == true)
 
 		w.WriteHeader(http.StatusAccepted)
 		JSONResponse(struct {
-			AccessToken string `json:accessToken`
+			AccessToken string `json:"accessToken"`
 		}{accessToken}, w)
 
 		return
@@ -207,6 +257,24 @@ func CheckEmailAvailability(email string) error {
 //CreateNewAccount creates an account if the sent data
 //is correctly formatted
 func PerformUserDataChecks(name string, email string, password string, repeatedPassword string) (httpStatus int, err error) {
+	if httpStatus, err = CheckUserName(name); err != nil {
+		return httpStatus, err
+	}
+
+	if httpStatus, err = CheckUserEmail(email); err != nil {
+		return httpStatus, err
+	}
+
+	err = CheckIfPasswordValid(password, repeatedPassword)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// CheckUserName verifies that the name is set and not used by another user
+func CheckUserName(name string) (httpStatus int, err error) {
 	if len(name) == 0 {
 		return http.StatusBadRequest, errors.New("vardas yra privalomas")
 	}
@@ -216,6 +284,11 @@ func PerformUserDataChecks(name string, email string, password string, repeatedP
 		return http.StatusConflict, err
 	}
 
+	return http.StatusOK, nil
+}
+
+// CheckUserEmail verifies the email format and that it is still free
+func CheckUserEmail(email string) (httpStatus int, err error) {
 	if !emailRegex.MatchString(email) {
 		return http.StatusBadRequest, errors.New("blogas el.pašto formatas")
 	}
@@ -225,11 +298,6 @@ func PerformUserDataChecks(name string, email string, password string, repeatedP
 		return http.StatusConflict, err
 	}
 
-	err = CheckIfPasswordValid(password, repeatedPassword)
-	if err != nil {
-		return http.StatusBadRequest, err
-	}
-
 	return http.StatusOK, nil
 }
 
@@ -252,20 +320,23 @@ func CheckIfPasswordValid(passwordOne string, passwordTwo string) error {
 	return nil
 }
 
-func MakeTokens(w http.ResponseWriter, user User) (string, string) {
+// MakeTokens issues access and refresh tokens. steppedUp marks
+// that the user passed two factor authentication
+func MakeTokens(w http.ResponseWriter, user User, steppedUp ...bool) (string, string) {
 	claims := map[string]interface{}{
 		"name":        user.Name,
 		"email":       user.Email,
 		"permissions": user.Permissions,
 		"isSet":       true, // For frontend
 		"shop":        user.ShopCodename,
+		"mfa":         len(steppedUp) > 0 && steppedUp[0],
 		"exp":         time.Now().Add(time.Second * 59).Unix(),
 	}
 	accessToken, _ := GenerateToken(claims)
 	// http.SetCookie(w, &http.Cookie{Name: "Access-Token", Value: accessToken, MaxAge: 60, SameSite: http.SameSiteNoneMode, Secure: true})
 	http.SetCookie(w, &http.Cookie{Name: "Access-Token", Value: accessToken, MaxAge: 60})
 
-	claims["exp"] = time.Now().Add(time.Hour * 24 * 7).Unix()
+	claims["exp"] = time.Now().Add(refreshTokenLifetime).Unix()
 	refreshToken, _ := GenerateToken(claims)
 
 	refreshDatabaseEntry := RefreshToken{
@@ -275,7 +346,7 @@ func MakeTokens(w http.ResponseWriter, user User) (string, string) {
 	db.Create(&refreshDatabaseEntry)
 
 	// http.SetCookie(w, &http.Cookie{Name: "Refresh-Token", Value: refreshToken, HttpOnly: true, MaxAge: 60 * 60 * 24 * 7, SameSite: http.SameSiteNoneMode, Secure: true})
-	http.SetCookie(w, &http.Cookie{Name: "Refresh-Token", Value: refreshToken, HttpOnly: true, MaxAge: 60 * 60 * 24 * 7})
+	http.SetCookie(w, &http.Cookie{Name: "Refresh-Token", Value: refreshToken, HttpOnly: true, MaxAge: int(refreshTokenLifetime.Seconds())})
 
 	return accessToken, refreshToken
 }
@@ -294,15 +365,36 @@ func GenerateSecurePassword(password string, salt string) string {
 }
 
 func isCourier(next http.HandlerFunc) http.HandlerFunc {
-	return CheckPermissions(next, HasCourierPermissions)
+	return CheckPermissions(requireStepUp(next, "c"), HasCourierPermissions)
 }
 
 func isAdmin(next http.HandlerFunc) http.HandlerFunc {
-	return CheckPermissions(next, HasAdminPermissions)
+	return CheckPermissions(requireStepUp(next, "a"), HasAdminPermissions)
 }
 
 func isFarmer(next http.HandlerFunc) http.HandlerFunc {
-	return CheckPermissions(next, HasFarmerPermissions)
+	return CheckPermissions(requireStepUp(next, "f"), HasFarmerPermissions)
+}
+
+// isAdminOrCourier lets both roles through, step-up is required by the
+// policies of the roles the user has
+func isAdminOrCourier(next http.HandlerFunc) http.HandlerFunc {
+	return CheckPermissions(func(w http.ResponseWriter, r *http.Request) {
+		permissions := *GetClaim("permissions", r)
+
+		roles := ""
+		if HasAdminPermissions(permissions) {
+			roles += "a"
+		}
+
+		if HasCourierPermissions(permissions) {
+			roles += "c"
+		}
+
+		requireStepUp(next, roles).ServeHTTP(w, r)
+	}, func(permissions string) bool {
+		return HasAdminPermissions(permissions) || HasCourierPermissions(permissions)
+	})
 }
 
 func CheckPermissions(next http.HandlerFunc, hasPermissions permissionValidator) http.HandlerFunc {
@@ -345,15 +437,12 @@ func isProductOwner(next http.HandlerFunc) http.HandlerFunc {
 func WithContext(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims := jwt.MapClaims{}
-		accessTokenCookie, err := r.Cookie("Access-Token")
-		if err == nil {
-			jwt.ParseWithClaims(accessTokenCookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
-				_, ok := token.Method.(*jwt.SigningMethodHMAC)
-				if !ok {
-					return nil, fmt.Errorf("įvyko klaida, bandykite dar kartą")
-				}
-				return signKey, nil
-			})
+		if accessToken, ok := GetAccessToken(r); ok {
+			ParseToken(accessToken, claims)
+		}
+
+		if claims["purpose"] != nil {
+			claims = jwt.MapClaims{}
 		}
 
 		ctx := context.WithValue(r.Context(), ctxKey{}, claims)
@@ -363,42 +452,91 @@ func WithContext(next http.HandlerFunc) http.HandlerFunc {
 
 func isAuthorized(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		accessTokenCookie, err := r.Cookie("Access-Token")
-		if err == nil {
-			claims := jwt.MapClaims{}
-			token, err := jwt.ParseWithClaims(accessTokenCookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
-				_, ok := token.Method.(*jwt.SigningMethodHMAC)
-				if !ok {
-					return nil, fmt.Errorf("įvyko klaida, bandykite dar kartą")
-				}
-				return signKey, nil
-			})
-
-			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-
-			if token.Valid {
-				ctx := context.WithValue(r.Context(), ctxKey{}, claims)
-				next.ServeHTTP(w, r.WithContext(ctx))
-				return
-			}
+		accessToken, ok := GetAccessToken(r)
+		if !ok {
+			Unauthorized(w, "", "")
+			return
 		}
 
-		w.WriteHeader(http.StatusUnauthorized)
+		if len(accessToken) == 0 {
+			Unauthorized(w, "invalid_request", "malformed authorization header")
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := ParseToken(accessToken, claims)
+
+		if validationErr, isValidationErr := err.(*jwt.ValidationError); isValidationErr && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			Unauthorized(w, "invalid_token", "token expired")
+			return
+		}
+
+		// Two factor challenges are not access tokens
+		if err != nil || !token.Valid || claims["purpose"] != nil {
+			Unauthorized(w, "invalid_token", "malformed token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// GetAccessToken reads the access token from the Authorization header
+// and falls back to the Access-Token cookie. The header takes precedence
+// so API clients are not affected by stale browser cookies. An empty
+// token with ok set means the Authorization header was malformed
+func GetAccessToken(r *http.Request) (token string, ok bool) {
+	if header := r.Header.Get("Authorization"); len(header) > 0 {
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", true
+		}
+
+		return strings.TrimSpace(parts[1]), true
+	}
+
+	accessTokenCookie, err := r.Cookie("Access-Token")
+	if err != nil {
+		return "", false
+	}
+
+	return accessTokenCookie.Value, true
+}
+
+// Unauthorized responds with a RFC 6750 WWW-Authenticate challenge
+func Unauthorized(w http.ResponseWriter, code string, description string) {
+	challenge := `Bearer realm="miniGoApi"`
+	if len(code) > 0 {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, code, description)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
 func GenerateToken(claimsMap map[string]interface{}) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+	method := jwt.SigningMethod(jwt.SigningMethodHS256)
+	var key interface{} = signKey
+
+	kid := ""
+	if len(keyRing) > 0 {
+		signingKey := SigningKey(time.Now())
+		method, key, kid = signingKey.Method, signingKey.Private, signingKey.ID
+	}
+
+	token := jwt.New(method)
+
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
 
 	claims := token.Claims.(jwt.MapClaims)
 	for k, v := range claimsMap {
 		claims[k] = v
 	}
 
-	tokenString, err := token.SignedString(signKey)
+	tokenString, err := token.SignedString(key)
 
 	if err != nil {
 		return "", err
@@ -116,3 +116,76 @@ func TestLogin(t *testing.T) {
 		})
 	}
 }
+
+func TestBearerToken(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	_, courierToken, _ := InitAccount(app, "courier")
+	expiredToken, _ := GenerateToken(map[string]interface{}{"email": "courier", "permissions": "c", "exp": 1})
+
+	cases := []struct {
+		name          string
+		authorization string
+		cookie        *string
+		challenge     string
+		expected      int
+	}{
+		{
+			name:      "NoToken",
+			challenge: `Bearer realm="miniGoApi"`,
+			expected:  http.StatusUnauthorized,
+		},
+		{
+			name:          "BearerToken",
+			authorization: "Bearer " + courierToken,
+			expected:      http.StatusOK,
+		},
+		{
+			name:          "HeaderTakesPrecedence",
+			authorization: "Bearer asd",
+			cookie:        &courierToken,
+			challenge:     `Bearer realm="miniGoApi", error="invalid_token", error_description="malformed token"`,
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "ExpiredToken",
+			authorization: "Bearer " + expiredToken,
+			challenge:     `Bearer realm="miniGoApi", error="invalid_token", error_description="token expired"`,
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "WrongScheme",
+			authorization: "Basic " + courierToken,
+			challenge:     `Bearer realm="miniGoApi", error="invalid_request", error_description="malformed authorization header"`,
+			expected:      http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := apitest.New(c.name).
+				Handler(app.Router).
+				Get("/courier/deliveries")
+
+			if len(c.authorization) > 0 {
+				test.Header("Authorization", c.authorization)
+			}
+
+			if c.cookie != nil {
+				test.Cookie("Access-Token", *c.cookie)
+			}
+
+			response := test.Expect(t).Status(c.expected)
+
+			if len(c.challenge) > 0 {
+				response.Header("WWW-Authenticate", c.challenge)
+			}
+
+			response.End()
+		})
+	}
+}
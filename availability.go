@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Product availability states. Coming soon products are shown to buyers
+// but can not be ordered before their availability window opens
+const (
+	availabilityAvailable  = "available"
+	availabilityComingSoon = "comingSoon"
+	availabilityEnded      = "ended"
+	availabilityHidden     = "hidden"
+)
+
+// A product is visible when it is public or its publish time has passed,
+// until it is unpublished or its season ends. ScheduleProducts later
+// moves elapsed schedules into Public, which keeps the result the same
+const productVisibleSQL = `(products.public = true OR products.publish_at <= now())
+	AND (products.unpublish_at IS NULL OR products.unpublish_at > now())
+	AND (products.available_until IS NULL OR products.available_until > now())`
+
+var errBadScheduleTime = errors.New("blogas datos formatas, naudokite 2006-01-02 arba RFC3339")
+
+// ============================= Helpers =============================
+
+// ProductAvailability tells whether the product can be ordered at the given time
+func ProductAvailability(product Product, now time.Time) string {
+	published := product.Public || (product.PublishAt != nil && !product.PublishAt.After(now))
+	if !published || (product.UnpublishAt != nil && !product.UnpublishAt.After(now)) {
+		return availabilityHidden
+	}
+
+	if product.AvailableUntil != nil && !product.AvailableUntil.After(now) {
+		return availabilityEnded
+	}
+
+	if product.AvailableFrom != nil && product.AvailableFrom.After(now) {
+		return availabilityComingSoon
+	}
+
+	return availabilityAvailable
+}
+
+// AvailabilityError is the reason a product can not be ordered, empty when it can
+func AvailabilityError(product Product, now time.Time) string {
+	switch ProductAvailability(product, now) {
+	case availabilityHidden:
+		return "produktas neparduodamas"
+	case availabilityEnded:
+		return "produkto sezonas baigėsi"
+	case availabilityComingSoon:
+		return fmt.Sprintf("produktas bus parduodamas nuo %s", product.AvailableFrom.Format("2006-01-02"))
+	}
+
+	return ""
+}
+
+// ParseScheduleTime parses a date or an RFC3339 time. An empty value
+// clears the schedule
+func ParseScheduleTime(value string) (*time.Time, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return &parsed, nil
+		}
+	}
+
+	return nil, errBadScheduleTime
+}
+
+// ValidateSchedule makes sure every window ends after it starts
+func ValidateSchedule(product Product) error {
+	if product.PublishAt != nil && product.UnpublishAt != nil && !product.UnpublishAt.After(*product.PublishAt) {
+		return errors.New("nepublikavimo laikas turi būti vėlesnis už publikavimo laiką")
+	}
+
+	if product.AvailableFrom != nil && product.AvailableUntil != nil && !product.AvailableUntil.After(*product.AvailableFrom) {
+		return errors.New("prekybos pabaiga turi būti vėlesnė už pradžią")
+	}
+
+	return nil
+}
+
+// ScheduleProducts publishes and unpublishes products whose scheduled time has passed
+func ScheduleProducts() {
+	db.Model(&Product{}).Where("publish_at <= now()").
+		Updates(map[string]interface{}{"public": true, "publish_at": nil})
+
+	db.Model(&Product{}).Where("unpublish_at <= now()").
+		Updates(map[string]interface{}{"public": false, "unpublish_at": nil})
+}
+
+func (p *Product) AfterFind(tx *gorm.DB) error {
+	p.Availability = ProductAvailability(*p, time.Now())
+	return nil
+}
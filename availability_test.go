@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProductAvailability(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	yesterday, tomorrow := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+
+	cases := []struct {
+		name     string
+		product  Product
+		expected string
+	}{
+		{name: "Public", product: Product{Public: true}, expected: availabilityAvailable},
+		{name: "NotPublic", product: Product{}, expected: availabilityHidden},
+		{name: "Published", product: Product{PublishAt: &yesterday}, expected: availabilityAvailable},
+		{name: "NotPublishedYet", product: Product{PublishAt: &tomorrow}, expected: availabilityHidden},
+		{name: "Unpublished", product: Product{Public: true, UnpublishAt: &yesterday}, expected: availabilityHidden},
+		{name: "ComingSoon", product: Product{Public: true, AvailableFrom: &tomorrow}, expected: availabilityComingSoon},
+		{name: "InSeason", product: Product{Public: true, AvailableFrom: &yesterday, AvailableUntil: &tomorrow}, expected: availabilityAvailable},
+		{name: "SeasonEnded", product: Product{Public: true, AvailableUntil: &yesterday}, expected: availabilityEnded},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if availability := ProductAvailability(c.product, now); availability != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, availability)
+			}
+		})
+	}
+}
+
+func TestParseScheduleTime(t *testing.T) {
+	if parsed, err := ParseScheduleTime(""); parsed != nil || err != nil {
+		t.Errorf("empty value should clear the schedule, got %v %v", parsed, err)
+	}
+
+	if parsed, err := ParseScheduleTime("2021-08-15"); err != nil || parsed.Day() != 15 {
+		t.Errorf("expected a date, got %v %v", parsed, err)
+	}
+
+	if parsed, err := ParseScheduleTime("2021-08-15T06:00:00+03:00"); err != nil || parsed.UTC().Hour() != 3 {
+		t.Errorf("expected an RFC3339 time, got %v %v", parsed, err)
+	}
+
+	if _, err := ParseScheduleTime("rugpjūčio 15"); err == nil {
+		t.Error("expected an error for a bad date")
+	}
+}
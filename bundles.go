@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shopspring/decimal"
+)
+
+// ============================= Helpers =============================
+
+// ParseBundleItems reads the bundle form value, a JSON array of
+// {"product": codename, "variant": sku, "quantity": n}
+func ParseBundleItems(r *http.Request) ([]BundleItem, error) {
+	var items []BundleItem
+	if err := json.Unmarshal([]byte(r.FormValue("bundle")), &items); err != nil {
+		return nil, errors.New("blogas rinkinio formatas")
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("rinkinyje turi būti bent vienas produktas")
+	}
+
+	return items, nil
+}
+
+// CheckBundleItems makes sure the components are other products of the
+// same shop, that they are not bundles themselves and that the
+// quantities can be ordered
+func CheckBundleItems(shopID string, bundleCodename string, items []BundleItem) error {
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		key := item.ComponentCodename + "/" + item.VariantSKU
+		if seen[key] {
+			return fmt.Errorf("rinkinio produktai kartojasi: %s", item.ComponentCodename)
+		}
+
+		seen[key] = true
+
+		if item.ComponentCodename == bundleCodename {
+			return errors.New("rinkinys negali būti savo paties dalis")
+		}
+
+		var component Product
+		err := db.Preload("Variants").Preload("BundleItems").
+			Take(&component, "codename = ? AND shop_id = ?", item.ComponentCodename, shopID).Error
+		if err != nil {
+			return fmt.Errorf("rinkinio produkto %s nepavyko rasti", item.ComponentCodename)
+		}
+
+		if len(component.BundleItems) > 0 {
+			return fmt.Errorf("rinkinys negali turėti kito rinkinio: %s", item.ComponentCodename)
+		}
+
+		if len(component.Variants) > 0 {
+			if _, ok := FindVariant(component, item.VariantSKU); !ok {
+				return fmt.Errorf("pasirinkite rinkinio produkto %s variantą", item.ComponentCodename)
+			}
+		}
+
+		if err = ValidateQuantity(item.Quantity, ProductStep(component)); err != nil {
+			return fmt.Errorf("%s: %s", item.ComponentCodename, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// CopyBundleItems prepares the components to be created again on a
+// product edit, like CopyVariants
+func CopyBundleItems(items []BundleItem) []BundleItem {
+	copies := make([]BundleItem, 0, len(items))
+
+	for _, item := range items {
+		item.ID = ""
+		item.BundleID = ""
+		copies = append(copies, item)
+	}
+
+	return copies
+}
+
+// BundleStock is the number of whole bundles the components' stock allows
+func BundleStock(bundle Product) decimal.Decimal {
+	var stock *decimal.Decimal
+
+	for _, item := range bundle.BundleItems {
+		var component Product
+		err := db.Preload("Variants").Take(&component, "codename = ? AND shop_id = ?", item.ComponentCodename, bundle.ShopID).Error
+		if err != nil || !item.Quantity.IsPositive() {
+			return decimal.Zero
+		}
+
+		available := component.Quantity
+		if len(item.VariantSKU) > 0 {
+			variant, _ := FindVariant(component, item.VariantSKU)
+			available = variant.Quantity
+		}
+
+		bundles := available.Div(item.Quantity).Floor()
+		if stock == nil || bundles.LessThan(*stock) {
+			stock = &bundles
+		}
+	}
+
+	if stock == nil || stock.IsNegative() {
+		return decimal.Zero
+	}
+
+	return *stock
+}
+
+// ApplyBundleStock shows the derived stock on the bundles among products
+func ApplyBundleStock(products []Product) {
+	for i := range products {
+		if len(products[i].BundleItems) > 0 {
+			products[i].Quantity = BundleStock(products[i])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseBundleItems(t *testing.T) {
+	cases := []struct {
+		name   string
+		bundle string
+		err    bool
+	}{
+		{name: "Valid", bundle: `[{"product":"desreles","quantity":"0.5"},{"product":"medus","variant":"honey-250","quantity":1}]`},
+		{name: "BadFormat", bundle: `{"product":"desreles"}`, err: true},
+		{name: "Empty", bundle: `[]`, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			form := url.Values{"bundle": {c.bundle}}
+			r := httptest.NewRequest("POST", "/products", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			items, err := ParseBundleItems(r)
+
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if len(items) != 2 || items[1].VariantSKU != "honey-250" || !items[0].Quantity.Equal(decimal.NewFromFloat(0.5)) {
+				t.Errorf("unexpected items %+v", items)
+			}
+		})
+	}
+}
+
+func TestCopyBundleItems(t *testing.T) {
+	items := []BundleItem{{ID: "1", BundleID: "bundle", ComponentCodename: "medus", Quantity: decimal.NewFromInt(2)}}
+	copies := CopyBundleItems(items)
+
+	if copies[0].ID != "" || copies[0].BundleID != "" || copies[0].ComponentCodename != "medus" {
+		t.Errorf("unexpected copy %+v", copies[0])
+	}
+
+	if items[0].ID != "1" {
+		t.Error("the original items must stay with the old product row")
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxImportSize = 10 << 20
+const maxImportRows = 5000
+
+// Columns of the catalog export, imports accept any subset of them in any
+// order. Products are matched by sku, then by codename
+var catalogColumns = []string{"sku", "codename", "name", "description", "price", "quantity", "categories", "public"}
+
+type ImportError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportReport struct {
+	DryRun  bool          `json:"dryRun"`
+	Rows    int           `json:"rows"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// catalogRow is a parsed import row, nil fields were left empty and keep
+// the product's current value
+type catalogRow struct {
+	Row         int
+	SKU         string
+	Codename    string
+	Name        *string
+	Description *string
+	Price       *decimal.Decimal
+	Quantity    *decimal.Decimal
+	Categories  []string
+	Public      *bool
+}
+
+type catalogChange struct {
+	Row        catalogRow
+	Product    Product
+	Previous   Product
+	Categories []Category
+	IsNew      bool
+}
+
+// ============================= Handlers =============================
+
+// ImportProducts creates and updates the shop's products from a CSV or
+// XLSX file. Nothing is saved when any row has errors, dryRun=true only
+// returns the report
+func ImportProducts(w http.ResponseWriter, r *http.Request) {
+	var shop Shop
+	if err := GetShopByEmail(*GetClaim("email", r), &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "prieš importuojant produktus privalote susikurti parduotuvę")
+		return
+	}
+
+	r.ParseMultipartForm(maxImportSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		Response(w, http.StatusBadRequest, "failas yra privalomas")
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxImportSize+1))
+	if err != nil || len(data) > maxImportSize {
+		Response(w, http.StatusBadRequest, "failas per didelis")
+		return
+	}
+
+	table, err := ReadCatalog(data)
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows, errors := ParseCatalogRows(table)
+	changes, planErrors := PlanCatalogImport(shop.ID, rows)
+
+	report := ImportReport{
+		DryRun: r.URL.Query().Get("dryRun") == "true",
+		Rows:   len(rows),
+		Errors: append(errors, planErrors...),
+	}
+
+	for _, change := range changes {
+		if change.IsNew {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+
+	if len(report.Errors) > 0 && !report.DryRun {
+		Response(w, http.StatusBadRequest, "importuojamame faile yra klaidų", report)
+		return
+	}
+
+	if report.DryRun {
+		JSONResponse(report, w)
+		return
+	}
+
+	if err = ApplyCatalogImport(changes, RequestActorID(r)); err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida bandant išsaugoti produktus")
+		return
+	}
+
+	RefreshProductSearch("shop_id = ?", shop.ID)
+	WriteAudit(r, "product.import", "shop", shop.ID)
+
+	JSONResponse(report, w)
+}
+
+// ExportProducts streams the shop's products as CSV, or as XLSX with format=xlsx
+func ExportProducts(w http.ResponseWriter, r *http.Request) {
+	var shop Shop
+	if err := GetShopByEmail(*GetClaim("email", r), &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "parduotuvė nerasta")
+		return
+	}
+
+	var write func([]string) error
+	var flush func() error
+
+	if r.URL.Query().Get("format") == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", `attachment; filename="produktai.xlsx"`)
+
+		writer, err := NewXLSXWriter(w)
+		if err != nil {
+			return
+		}
+
+		write, flush = writer.WriteRow, writer.Close
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="produktai.csv"`)
+
+		// The byte order mark lets Excel detect UTF-8
+		io.WriteString(w, "\ufeff")
+
+		writer := csv.NewWriter(w)
+		write = writer.Write
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	}
+
+	write(catalogColumns)
+
+	var products []Product
+	db.Preload("Categories").Where("shop_id = ?", shop.ID).Order("created_at").FindInBatches(&products, 200, func(tx *gorm.DB, batch int) error {
+		for _, product := range products {
+			if err := write(CatalogRecord(product)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	flush()
+}
+
+// ============================= Helpers =============================
+
+// ReadCatalog reads an XLSX file or a CSV separated by commas or semicolons
+func ReadCatalog(data []byte) ([][]string, error) {
+	if IsXLSX(data) {
+		return ReadXLSX(data)
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+
+	// Spreadsheets with a decimal comma separate CSV columns with semicolons
+	firstLine := data
+	if end := bytes.IndexByte(data, '\n'); end >= 0 {
+		firstLine = data[:end]
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	table, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("blogas CSV failas: %s", err.Error())
+	}
+
+	return table, nil
+}
+
+// ParseCatalogRows maps the columns by the header row and parses the values.
+// Row numbers count the header as the first row, like spreadsheets do
+func ParseCatalogRows(table [][]string) ([]catalogRow, []ImportError) {
+	errors := make([]ImportError, 0)
+
+	if len(table) == 0 {
+		return nil, append(errors, ImportError{Row: 1, Message: "failas tuščias"})
+	}
+
+	columns := make(map[string]int)
+	for i, header := range table[0] {
+		header = strings.ToLower(strings.TrimSpace(header))
+
+		known := false
+		for _, column := range catalogColumns {
+			known = known || column == header
+		}
+
+		if !known {
+			errors = append(errors, ImportError{Row: 1, Column: header, Message: "nežinomas stulpelis"})
+			continue
+		}
+
+		columns[header] = i
+	}
+
+	_, hasSKU := columns["sku"]
+	_, hasCodename := columns["codename"]
+	_, hasName := columns["name"]
+	if !hasSKU && !hasCodename && !hasName {
+		errors = append(errors, ImportError{Row: 1, Message: "faile turi būti sku, codename arba name stulpelis"})
+	}
+
+	if len(table)-1 > maxImportRows {
+		errors = append(errors, ImportError{Row: maxImportRows + 2, Message: fmt.Sprintf("faile gali būti ne daugiau nei %d produktų", maxImportRows)})
+	}
+
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	rows := make([]catalogRow, 0, len(table)-1)
+
+	for i, record := range table[1:] {
+		row := catalogRow{Row: i + 2}
+
+		value := func(column string) (string, bool) {
+			index, ok := columns[column]
+			if !ok || index >= len(record) {
+				return "", false
+			}
+
+			trimmed := strings.TrimSpace(record[index])
+			return trimmed, len(trimmed) > 0
+		}
+
+		empty := true
+		for _, cell := range record {
+			empty = empty && len(strings.TrimSpace(cell)) == 0
+		}
+
+		if empty {
+			continue
+		}
+
+		row.SKU, _ = value("sku")
+		row.Codename, _ = value("codename")
+
+		if name, ok := value("name"); ok {
+			row.Name = &name
+		}
+
+		if description, ok := value("description"); ok {
+			row.Description = &description
+		}
+
+		for _, column := range []string{"price", "quantity"} {
+			text, ok := value(column)
+			if !ok {
+				continue
+			}
+
+			parsed, err := decimal.NewFromString(strings.Replace(text, ",", ".", 1))
+			if err != nil || parsed.IsNegative() {
+				errors = append(errors, ImportError{Row: row.Row, Column: column, Message: "turi būti teigiamas skaičius"})
+				continue
+			}
+
+			if column == "price" {
+				row.Price = &parsed
+			} else {
+				row.Quantity = &parsed
+			}
+		}
+
+		if categories, ok := value("categories"); ok {
+			for _, codename := range strings.FieldsFunc(categories, func(r rune) bool { return r == ',' || r == ';' }) {
+				if codename = strings.TrimSpace(codename); len(codename) > 0 {
+					row.Categories = append(row.Categories, codename)
+				}
+			}
+		}
+
+		if public, ok := value("public"); ok {
+			switch strings.ToLower(public) {
+			case "true", "1", "taip", "yes":
+				row.Public = new(bool)
+				*row.Public = true
+			case "false", "0", "ne", "no":
+				row.Public = new(bool)
+			default:
+				errors = append(errors, ImportError{Row: row.Row, Column: "public", Message: "turi būti taip arba ne"})
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, errors
+}
+
+// PlanCatalogImport matches the rows to the shop's products and checks
+// them the way AddEditProduct does
+func PlanCatalogImport(shopID string, rows []catalogRow) ([]catalogChange, []ImportError) {
+	errors := make([]ImportError, 0)
+	changes := make([]catalogChange, 0, len(rows))
+
+	var products []Product
+	db.Preload("Variants").Preload("BundleItems").Where("shop_id = ?", shopID).Find(&products)
+
+	bySKU := make(map[string]Product)
+	byCodename := make(map[string]Product)
+	for _, product := range products {
+		if len(product.SKU) > 0 {
+			bySKU[product.SKU] = product
+		}
+
+		byCodename[product.Codename] = product
+	}
+
+	var categories []Category
+	db.Find(&categories)
+
+	categoriesByCodename := make(map[string]Category)
+	for _, category := range categories {
+		categoriesByCodename[category.Codename] = category
+	}
+
+	seen := make(map[string]int)
+
+	for _, row := range rows {
+		rowError := func(column string, message string) {
+			errors = append(errors, ImportError{Row: row.Row, Column: column, Message: message})
+		}
+
+		change := catalogChange{Row: row}
+
+		product, found := bySKU[row.SKU]
+		if len(row.SKU) == 0 || !found {
+			product, found = byCodename[row.Codename]
+		}
+
+		switch {
+		case len(row.Codename) > 0 && !found:
+			rowError("codename", "produktas nerastas")
+			continue
+		case found && len(row.Codename) > 0 && product.Codename != row.Codename:
+			rowError("sku", "kodas priklauso kitam produktui")
+			continue
+		case !found:
+			change.IsNew = true
+			product = Product{ShopID: shopID, Unit: "vnt", Step: decimal.NewFromInt(1), Description: new(string)}
+		}
+
+		key := product.ID
+		if change.IsNew {
+			key = "sku:" + row.SKU
+		}
+
+		if previous, ok := seen[key]; ok && (!change.IsNew || len(row.SKU) > 0) {
+			rowError("", fmt.Sprintf("produktas kartojasi %d eilutėje", previous))
+			continue
+		}
+
+		seen[key] = row.Row
+
+		if len(row.SKU) > 64 {
+			rowError("sku", "kodas per ilgas")
+			continue
+		}
+
+		if change.IsNew && row.Name == nil {
+			rowError("name", "produkto vardas privalomas")
+			continue
+		}
+
+		if row.Name != nil && len(*row.Name) > 100 {
+			rowError("name", "produkto vardas per ilgas")
+			continue
+		}
+
+		if change.IsNew && (row.Price == nil || row.Quantity == nil) {
+			rowError("", "kaina ir kiekis yra privalomi")
+			continue
+		}
+
+		if (row.Price != nil || row.Quantity != nil) && (len(product.Variants) > 0 || len(product.BundleItems) > 0) {
+			rowError("", "produkto su variantais ar rinkinio kaina ir kiekis keičiami per produkto redagavimą")
+			continue
+		}
+
+		for _, codename := range row.Categories {
+			category, ok := categoriesByCodename[codename]
+			if !ok {
+				rowError("categories", fmt.Sprintf("kategorija %s nerasta", codename))
+				break
+			}
+
+			change.Categories = append(change.Categories, category)
+		}
+
+		if len(change.Categories) != len(row.Categories) {
+			continue
+		}
+
+		change.Previous = product
+
+		if len(row.SKU) > 0 {
+			product.SKU = row.SKU
+		}
+
+		if row.Name != nil {
+			product.Name = row.Name
+		}
+
+		if change.IsNew {
+			product.Codename = GenerateCodename(*product.Name, true)
+		}
+
+		if row.Description != nil {
+			product.Description = row.Description
+		}
+
+		if row.Price != nil {
+			product.Price = *row.Price
+		}
+
+		if row.Quantity != nil {
+			product.Quantity = *row.Quantity
+		}
+
+		if row.Public != nil {
+			product.Public = *row.Public
+		}
+
+		change.Product = product
+		changes = append(changes, change)
+	}
+
+	return changes, errors
+}
+
+// ApplyCatalogImport saves every change in one transaction, each changed
+// product gets a new revision. Existing products are reloaded and locked,
+// only the columns their row set are written, so stock sold since the
+// import was planned is kept
+func ApplyCatalogImport(changes []catalogChange, actorID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, change := range changes {
+			product := change.Product
+			previous := change.Previous
+
+			if change.IsNew {
+				if err := tx.Omit("Shop", "Variants", "BundleItems", "Categories").Create(&product).Error; err != nil {
+					return err
+				}
+			} else {
+				err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Variants").Preload("BundleItems").
+					Take(&previous, "id = ?", product.ID).Error
+				if err != nil {
+					return err
+				}
+
+				if product, err = ApplyCatalogRow(tx, previous, change.Row); err != nil {
+					return err
+				}
+			}
+
+			if len(change.Row.Categories) > 0 {
+				if err := tx.Model(&product).Association("Categories").Replace(change.Categories); err != nil {
+					return err
+				}
+			}
+
+			if err := RecordStockChanges(tx, previous, product, movementImport, actorID); err != nil {
+				return err
+			}
+
+			if err := CreateRevision(tx, &product); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ApplyCatalogRow updates the columns the row set on the locked product
+func ApplyCatalogRow(tx *gorm.DB, product Product, row catalogRow) (Product, error) {
+	updates := make(map[string]interface{})
+
+	if len(row.SKU) > 0 {
+		product.SKU = row.SKU
+		updates["sku"] = product.SKU
+	}
+
+	if row.Name != nil {
+		product.Name = row.Name
+		updates["name"] = *product.Name
+	}
+
+	if row.Description != nil {
+		product.Description = row.Description
+		updates["description"] = *product.Description
+	}
+
+	if (row.Price != nil || row.Quantity != nil) && (len(product.Variants) > 0 || len(product.BundleItems) > 0) {
+		return product, fmt.Errorf("%d eilutė: produkto su variantais ar rinkinio kaina ir kiekis keičiami per produkto redagavimą", row.Row)
+	}
+
+	if row.Price != nil {
+		product.Price = *row.Price
+		updates["price"] = product.Price
+	}
+
+	if row.Quantity != nil {
+		product.Quantity = *row.Quantity
+		updates["quantity"] = product.Quantity
+	}
+
+	if row.Public != nil {
+		product.Public = *row.Public
+		updates["public"] = product.Public
+	}
+
+	if len(updates) == 0 {
+		return product, nil
+	}
+
+	return product, tx.Model(&product).Updates(updates).Error
+}
+
+// CatalogRecord is the product's export row in catalogColumns order
+func CatalogRecord(product Product) []string {
+	categories := make([]string, 0, len(product.Categories))
+	for _, category := range product.Categories {
+		categories = append(categories, category.Codename)
+	}
+
+	name, description := "", ""
+	if product.Name != nil {
+		name = *product.Name
+	}
+
+	if product.Description != nil {
+		description = *product.Description
+	}
+
+	public := "false"
+	if product.Public {
+		public = "true"
+	}
+
+	return []string{product.SKU, product.Codename, name, description, product.Price.String(), product.Quantity.String(), strings.Join(categories, ","), public}
+}
+
+// CheckProductSKU makes sure the SKU is not used by another product of the shop
+func CheckProductSKU(shopID string, productID string, sku string) error {
+	if len(sku) > 64 {
+		return fmt.Errorf("kodas per ilgas")
+	}
+
+	err := db.Select("id").Take(&Product{}, "shop_id = ? AND sku = ? AND id <> ?", shopID, sku, productID).Error
+	if err == nil {
+		return fmt.Errorf("toks produkto kodas jau naudojamas: %s", sku)
+	}
+
+	return nil
+}
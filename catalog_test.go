@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadCatalog(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+	}{
+		{name: "Comma", data: "sku,name,price\nA-1,Medus,\"4,50\"\n"},
+		{name: "Semicolon", data: "sku;name;price\nA-1;Medus;4,50\n"},
+		{name: "ByteOrderMark", data: "\ufeffsku,name,price\nA-1,Medus,\"4,50\"\n"},
+	}
+
+	expected := [][]string{{"sku", "name", "price"}, {"A-1", "Medus", "4,50"}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			table, err := ReadCatalog([]byte(c.data))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if !reflect.DeepEqual(table, expected) {
+				t.Errorf("expected %v, got %v", expected, table)
+			}
+		})
+	}
+}
+
+func TestParseCatalogRows(t *testing.T) {
+	table := [][]string{
+		{"SKU", "Name", "Price", "Quantity", "Categories", "Public"},
+		{"A-1", "Medus", "4,50", "10", "maistas, medus", "taip"},
+		{"", "", "", "", "", ""},
+		{"A-2", "Sūris", "-1", "abc", "", "gal"},
+	}
+
+	rows, errors := ParseCatalogRows(table)
+
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+
+	row := rows[0]
+	if row.Row != 2 || row.SKU != "A-1" || *row.Name != "Medus" || row.Price.String() != "4.5" || !*row.Public {
+		t.Errorf("unexpected row %+v", row)
+	}
+
+	if !reflect.DeepEqual(row.Categories, []string{"maistas", "medus"}) {
+		t.Errorf("unexpected categories %v", row.Categories)
+	}
+
+	if rows[1].Row != 4 || len(errors) != 3 {
+		t.Fatalf("expected 3 errors on row 4, got %+v", errors)
+	}
+
+	for i, column := range []string{"price", "quantity", "public"} {
+		if errors[i].Row != 4 || errors[i].Column != column {
+			t.Errorf("unexpected error %+v", errors[i])
+		}
+	}
+}
+
+func TestParseCatalogHeader(t *testing.T) {
+	_, errors := ParseCatalogRows([][]string{{"price", "weight"}})
+
+	if len(errors) != 2 || errors[0].Column != "weight" {
+		t.Errorf("unexpected errors %+v", errors)
+	}
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	rows := [][]string{catalogColumns, {"A-1", "medus", "Medus <liepų> & grikių", "", "4.5", "10", "maistas", "true"}}
+
+	var file bytes.Buffer
+	writer, err := NewXLSXWriter(&file)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, row := range rows {
+		writer.WriteRow(row)
+	}
+	writer.Close()
+
+	if !IsXLSX(file.Bytes()) {
+		t.Fatal("expected an XLSX file")
+	}
+
+	table, err := ReadCatalog(file.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !reflect.DeepEqual(table, rows) {
+		t.Errorf("expected %v, got %v", rows, table)
+	}
+}
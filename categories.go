@@ -4,13 +4,30 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 // ========================== Categories ==============================
+var categoryList = listDefinition{
+	Table: "categories",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+		"name":      {Column: "name", Field: "Name"},
+	},
+	DefaultSort: "-createdAt",
+}
+
 func GetCategories(w http.ResponseWriter, r *http.Request) {
-	var categories []Category
-	db.Order("created_at desc").Find(&categories)
-	JSONResponse(categories, w)
+	categories := make([]Category, 0)
+
+	params, err := ParseListParams(r, categoryList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	page, err := Paginate(db, &Category{}, func(tx *gorm.DB) *gorm.DB { return tx }, params, &categories)
+	PageResponse(w, page, err)
 }
 
 func GetCategory(w http.ResponseWriter, r *http.Request) {
@@ -33,7 +50,13 @@ func CreateCategory(w http.ResponseWriter, r *http.Request) {
 
 	var request Category
 
-	request.File = FileUpload(r, "file", "category-*.png")
+	image, err := FileUpload(r, "file", "category")
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	request.File = image
 	name := r.FormValue("name")
 
 	if len(name) == 0 {
@@ -45,6 +68,7 @@ func CreateCategory(w http.ResponseWriter, r *http.Request) {
 	request.Codename = GenerateCodename(name, false)
 	db.Create(&request)
 
+	WriteAuditChange(r, "category.create", "category", request.ID, nil, request)
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -62,7 +86,14 @@ func UpdateCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image := FileUpload(r, "file", "category-*.png")
+	before := AuditFields(category)
+
+	image, err := FileUpload(r, "file", "category")
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	name := r.FormValue("name")
 
 	if len(name) > 0 && *category.Name != name {
@@ -75,13 +106,24 @@ func UpdateCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	db.Save(&category)
+	RefreshProductSearch("id IN (?)", db.Table("product_categories").Select("product_id").Where("category_id = ?", category.ID))
+
+	WriteAuditChange(r, "category.update", "category", category.ID, before, category)
 }
 
 func DeleteCategory(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	caregoryID := params["categoryid"]
 
-	db.Unscoped().Delete(&Category{}, "id = ?", caregoryID)
+	var category Category
+	if db.Take(&category, "id = ?", caregoryID).Error != nil {
+		return
+	}
+
+	db.Unscoped().Delete(&category)
+	RefreshProductSearch("id IN (?)", db.Table("product_categories").Select("product_id").Where("category_id = ?", category.ID))
+
+	WriteAuditChange(r, "category.delete", "category", category.ID, category, nil)
 }
 
 // ===================================================================
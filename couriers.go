@@ -17,21 +17,42 @@ func GetDeliveries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var orders []Order
+	orders := make([]Order, 0)
+
+	params, err := ParseListParams(r, orderList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	statusFilter, err := StatusFilter(r, "orders.status")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	createdFilter, err := DateRangeFilter(r, "orders.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
 
 	tx := db.Preload(clause.Associations)
 	tx.Preload("ShopOrders", func(db *gorm.DB) *gorm.DB {
 		return db.Order("created_at desc")
 	})
 
-	tx.Preload("ShopOrders.OrderedProducts").Preload("ShopOrders.Collector")
-	tx.Preload("ShopOrders.OrderedProducts.Product", func(db *gorm.DB) *gorm.DB {
+	PreloadOrderedProducts(tx, "ShopOrders.OrderedProducts")
+	tx.Preload("ShopOrders.Collector").Preload("ShopOrders.Shop", func(db *gorm.DB) *gorm.DB {
 		return db.Unscoped()
-	}).Preload("ShopOrders.Shop")
-	tx.Where("status > ?", 2).Where("status < ?", 5).Where("delivered_by = ?", courier.ID)
+	})
+	filters := func(tx *gorm.DB) *gorm.DB {
+		tx.Where("orders.status > ?", 2).Where("orders.status < ?", 5).Where("orders.delivered_by = ?", courier.ID)
+		return createdFilter(statusFilter(tx))
+	}
 
-	tx.Order("created_at desc").Find(&orders)
-	JSONResponse(orders, w)
+	page, err := Paginate(tx, &Order{}, filters, params, &orders)
+	PageResponse(w, page, err)
 }
 
 func GetPickups(w http.ResponseWriter, r *http.Request) {
@@ -45,9 +66,8 @@ func GetPickups(w http.ResponseWriter, r *http.Request) {
 
 	var shopOrders []ShopOrder
 
-	tx := db.Unscoped().Preload(clause.Associations).Preload("OrderedProducts").Preload("OrderedProducts.Product", func(db *gorm.DB) *gorm.DB {
-		return db.Unscoped()
-	})
+	tx := db.Unscoped().Preload(clause.Associations)
+	PreloadOrderedProducts(tx, "OrderedProducts")
 
 	tx.Joins("left join orders on orders.id = shop_orders.order_id").Where("orders.pickup_date > ?", time.Now())
 	tx.Where("shop_orders.status < ? AND shop_orders.status > ?", 3, 0).Where("collected_by = ?", courier.ID).Order("orders.pickup_date").Find(&shopOrders)
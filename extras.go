@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 
@@ -85,6 +88,18 @@ func GetClaim(name string, r *http.Request) *string {
 	return nil
 }
 
+// RequestActorID returns the ID of the authorized user, empty if there is none
+func RequestActorID(r *http.Request) string {
+	email := GetClaim("email", r)
+	if email == nil {
+		return ""
+	}
+
+	var actor User
+	db.Select("id").Take(&actor, "email = ?", *email)
+	return actor.ID
+}
+
 func GetSingleParameter(r *http.Request, key string) string {
 	value := r.Form[key]
 
@@ -95,34 +110,38 @@ func GetSingleParameter(r *http.Request, key string) string {
 	return ""
 }
 
-func FileUpload(r *http.Request, formFile string, namePattern string) string {
-	// FormFile returns the first file for the given key `myFile`
-	// it also returns the FileHeader so we can get the Filename,
-	// the Header and the size of the file
-	file, _, err := r.FormFile("file")
+// FileUpload saves the image uploaded as formFile, see SaveImage. No
+// upload is not an error, the path is empty then
+func FileUpload(r *http.Request, formFile string, prefix string) (ImagePath, error) {
+	file, _, err := r.FormFile(formFile)
 	if err != nil {
-		return ""
+		return "", nil
 	}
 	defer file.Close()
 
-	// Create a temporary file within our temp-images directory that follows
-	// a particular naming pattern
-	tempFile, err := ioutil.TempFile("images", namePattern)
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize+1))
 	if err != nil {
-		return ""
+		return "", err
 	}
-	defer tempFile.Close()
 
-	// read all of the contents of our uploaded file into a
-	// byte array
-	fileBytes, err := ioutil.ReadAll(file)
+	return SaveImage(data, prefix)
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only
+// trusted when the API runs behind a proxy (TRUST_PROXY=true)
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return ""
+		return r.RemoteAddr
 	}
-	// write this byte array to our temporary file
-	tempFile.Write(fileBytes)
 
-	return tempFile.Name()
+	return host
 }
 
 func GenerateOrderIdentifier() string {
@@ -182,6 +201,11 @@ func CreateTempUser(user User) error {
 		return errors.New("blogas el.pašto formatas")
 	}
 
+	// Guests can place several orders with the same email
+	if IsTemporaryEmail(user.Email) {
+		return nil
+	}
+
 	err := CheckEmailAvailability(user.Email)
 	if err != nil {
 		return err
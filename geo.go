@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const defaultRadius = 25.0
+const maxRadius = 500.0
+
+// Distances are calculated with the earthdistance extension. The GiST
+// index lets earth_box narrow the locations down before the exact
+// earth_distance check
+const geoSetupSQL = `
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+CREATE INDEX IF NOT EXISTS idx_locations_earth ON locations USING gist (ll_to_earth(lat, lng));
+CREATE INDEX IF NOT EXISTS idx_locations_type ON locations (type);
+`
+
+// GeoFilter limits results to shops with a location within Radius km of
+// Lat, Lng. Types optionally limits the kinds of locations considered
+type GeoFilter struct {
+	Near   bool
+	Lat    float64
+	Lng    float64
+	Radius float64
+	Types  []string
+}
+
+var errBadLocation = fmt.Errorf("%w: near=platuma,ilguma", errBadListParams)
+
+// ParseGeoFilter reads near=lat,lng, radius (km) and type. Returns nil
+// when none of them are given
+func ParseGeoFilter(r *http.Request) (*GeoFilter, error) {
+	query := r.URL.Query()
+	filter := GeoFilter{Radius: defaultRadius}
+
+	for _, param := range query["type"] {
+		for _, locationType := range strings.Split(param, ",") {
+			if locationType = strings.TrimSpace(locationType); len(locationType) > 0 {
+				filter.Types = append(filter.Types, locationType)
+			}
+		}
+	}
+
+	near := query.Get("near")
+	if len(near) == 0 {
+		if len(filter.Types) == 0 {
+			return nil, nil
+		}
+
+		return &filter, nil
+	}
+
+	coordinates := strings.Split(near, ",")
+	if len(coordinates) != 2 {
+		return nil, errBadLocation
+	}
+
+	var err error
+	if filter.Lat, err = strconv.ParseFloat(strings.TrimSpace(coordinates[0]), 64); err != nil || filter.Lat < -90 || filter.Lat > 90 {
+		return nil, errBadLocation
+	}
+
+	if filter.Lng, err = strconv.ParseFloat(strings.TrimSpace(coordinates[1]), 64); err != nil || filter.Lng < -180 || filter.Lng > 180 {
+		return nil, errBadLocation
+	}
+
+	if radius := query.Get("radius"); len(radius) > 0 {
+		filter.Radius, err = strconv.ParseFloat(radius, 64)
+		if err != nil || filter.Radius <= 0 {
+			return nil, errBadLocation
+		}
+
+		if filter.Radius > maxRadius {
+			filter.Radius = maxRadius
+		}
+	}
+
+	filter.Near = true
+	return &filter, nil
+}
+
+// NearbyShops is a subquery of shop_id and the distance in km to the
+// shop's closest matching location
+func (g GeoFilter) NearbyShops() *gorm.DB {
+	tx := db.Table("locations")
+
+	if g.Near {
+		meters := g.Radius * 1000
+
+		tx.Select("shop_id, MIN(earth_distance(ll_to_earth(?, ?), ll_to_earth(lat, lng))) / 1000 AS distance", g.Lat, g.Lng)
+		tx.Where("earth_box(ll_to_earth(?, ?), ?) @> ll_to_earth(lat, lng)", g.Lat, g.Lng, meters)
+		tx.Where("earth_distance(ll_to_earth(?, ?), ll_to_earth(lat, lng)) <= ?", g.Lat, g.Lng, meters)
+	} else {
+		tx.Select("shop_id, NULL::float8 AS distance")
+	}
+
+	if len(g.Types) > 0 {
+		tx.Where("type IN ?", g.Types)
+	}
+
+	return tx.Group("shop_id")
+}
+
+// JoinNearby joins NearbyShops as "nearby" on the given shop ID column
+func (g GeoFilter) JoinNearby(tx *gorm.DB, shopIDColumn string) *gorm.DB {
+	return tx.Joins("JOIN (?) AS nearby ON nearby.shop_id = "+shopIDColumn, g.NearbyShops())
+}
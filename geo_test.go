@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseGeoFilter(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		expected *GeoFilter
+		err      bool
+	}{
+		{name: "NoFilter", query: ""},
+		{name: "Near", query: "near=54.68,25.27&radius=10", expected: &GeoFilter{Near: true, Lat: 54.68, Lng: 25.27, Radius: 10}},
+		{name: "DefaultRadius", query: "near=54.68,25.27", expected: &GeoFilter{Near: true, Lat: 54.68, Lng: 25.27, Radius: defaultRadius}},
+		{name: "RadiusIsCapped", query: "near=54.68,25.27&radius=10000", expected: &GeoFilter{Near: true, Lat: 54.68, Lng: 25.27, Radius: maxRadius}},
+		{name: "TypeOnly", query: "type=market,farm", expected: &GeoFilter{Radius: defaultRadius, Types: []string{"market", "farm"}}},
+		{name: "BadCoordinates", query: "near=54.68", err: true},
+		{name: "LatitudeOutOfRange", query: "near=95,25.27", err: true},
+		{name: "BadRadius", query: "near=54.68,25.27&radius=-1", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filter, err := ParseGeoFilter(httptest.NewRequest("GET", "/shops?"+c.query, nil))
+
+			if c.err {
+				if !errors.Is(err, errBadListParams) {
+					t.Errorf("expected a bad parameters error, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(filter, c.expected) {
+				t.Errorf("expected %+v, got %+v", c.expected, filter)
+			}
+		})
+	}
+}
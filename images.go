@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const maxImageSize = 10 << 20
+const maxImageSide = 6000
+const maxImagePixels = 24000000
+
+var errImageFormat = errors.New("netinkamas paveikslėlio formatas, leidžiami JPEG ir PNG")
+var errImageTooLarge = fmt.Errorf("paveikslėlis per didelis, daugiausiai %dx%d taškų", maxImageSide, maxImageSide)
+
+// imageSizes are the widths uploads are resized to. Narrower images keep
+// their width, they are never scaled up
+var imageSizes = []struct {
+	Name  string
+	Width int
+}{
+	{"thumbnail", 200},
+	{"card", 600},
+	{"full", 1600},
+}
+
+// ImagePath is where an uploaded image is stored, the path of its full
+// size. The other sizes are stored next to it, images uploaded before
+// resizing only have the one file
+type ImagePath string
+
+type imageURLs struct {
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail"`
+	Card      string `json:"card"`
+	Full      string `json:"full"`
+	SrcSet    string `json:"srcset,omitempty"`
+}
+
+// ============================= Helpers =============================
+
+// Size is the path of one of the imageSizes
+func (p ImagePath) Size(name string) string {
+	if !strings.Contains(string(p), "-full.") {
+		return string(p)
+	}
+
+	return strings.Replace(string(p), "-full.", "-"+name+".", 1)
+}
+
+// MarshalJSON shows the image with the URLs of every size
+func (p ImagePath) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+
+	urls := imageURLs{URL: string(p), Thumbnail: p.Size("thumbnail"), Card: p.Size("card"), Full: string(p)}
+
+	if p.Size("thumbnail") != string(p) {
+		srcSet := make([]string, 0, len(imageSizes))
+		for _, size := range imageSizes {
+			srcSet = append(srcSet, fmt.Sprintf("%s %dw", p.Size(size.Name), size.Width))
+		}
+
+		urls.SrcSet = strings.Join(srcSet, ", ")
+	}
+
+	return json.Marshal(urls)
+}
+
+// UnmarshalJSON reads both the plain path and the URLs object
+func (p *ImagePath) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*p = ImagePath(path)
+		return nil
+	}
+
+	var urls *imageURLs
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return err
+	}
+
+	*p = ""
+	if urls != nil {
+		*p = ImagePath(urls.Full)
+	}
+
+	return nil
+}
+
+// SaveImage checks an upload and stores it in every size under images/.
+// Decoding and encoding it again also drops the EXIF data
+func SaveImage(data []byte, prefix string) (ImagePath, error) {
+	if len(data) > maxImageSize {
+		return "", fmt.Errorf("paveikslėlis per didelis, daugiausiai %d MB", maxImageSize>>20)
+	}
+
+	switch http.DetectContentType(data) {
+	case "image/jpeg", "image/png":
+	default:
+		return "", errImageFormat
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errImageFormat
+	}
+
+	if err = CheckImageSize(config.Width, config.Height); err != nil {
+		return "", err
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", errImageFormat
+	}
+
+	source := image.NewRGBA(decoded.Bounds().Sub(decoded.Bounds().Min))
+	draw.Draw(source, source.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	extension := ".png"
+	if format == "jpeg" {
+		extension = ".jpg"
+		source = Orient(source, JPEGOrientation(data))
+	}
+
+	full, err := ioutil.TempFile("images", prefix+"-*-full"+extension)
+	if err != nil {
+		return "", err
+	}
+	full.Close()
+
+	path := ImagePath(full.Name())
+
+	for _, size := range imageSizes {
+		var buffer bytes.Buffer
+		resized := Resize(source, size.Width)
+
+		if format == "jpeg" {
+			err = jpeg.Encode(&buffer, resized, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buffer, resized)
+		}
+
+		if err == nil {
+			err = ioutil.WriteFile(path.Size(size.Name), buffer.Bytes(), 0644)
+		}
+
+		if err != nil {
+			RemoveImage(path)
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// RemoveImage deletes every stored size of an image
+func RemoveImage(path ImagePath) {
+	for _, size := range imageSizes {
+		os.Remove(path.Size(size.Name))
+	}
+}
+
+func CheckImageSize(width int, height int) error {
+	if width < 1 || height < 1 {
+		return errImageFormat
+	}
+
+	if width > maxImageSide || height > maxImageSide || width*height > maxImagePixels {
+		return errImageTooLarge
+	}
+
+	return nil
+}
+
+// Resize scales the image down to the width by averaging the source
+// pixels each target pixel covers
+func Resize(source *image.RGBA, width int) *image.RGBA {
+	sourceWidth, sourceHeight := source.Bounds().Dx(), source.Bounds().Dy()
+	if sourceWidth <= width {
+		return source
+	}
+
+	height := sourceHeight * width / sourceWidth
+	if height < 1 {
+		height = 1
+	}
+
+	target := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sourceHeight/height, (y+1)*sourceHeight/height
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sourceWidth/width, (x+1)*sourceWidth/width
+			if x1 == x0 {
+				x1++
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := source.Pix[sy*source.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+
+			count := (x1 - x0) * (y1 - y0)
+			offset := y*target.Stride + x*4
+			for c := 0; c < 4; c++ {
+				target.Pix[offset+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+
+	return target
+}
+
+// Orient turns the image upright by its EXIF orientation (1-8), since the
+// orientation is dropped with the rest of the EXIF data
+func Orient(source *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return source
+	}
+
+	width, height := source.Bounds().Dx(), source.Bounds().Dy()
+
+	// Orientations 5-8 swap the sides
+	targetWidth, targetHeight := width, height
+	if orientation >= 5 {
+		targetWidth, targetHeight = height, width
+	}
+
+	target := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var tx, ty int
+			switch orientation {
+			case 2:
+				tx, ty = width-1-x, y
+			case 3:
+				tx, ty = width-1-x, height-1-y
+			case 4:
+				tx, ty = x, height-1-y
+			case 5:
+				tx, ty = y, x
+			case 6:
+				tx, ty = height-1-y, x
+			case 7:
+				tx, ty = height-1-y, width-1-x
+			case 8:
+				tx, ty = y, width-1-x
+			}
+
+			copy(target.Pix[ty*target.Stride+tx*4:ty*target.Stride+tx*4+4], source.Pix[y*source.Stride+x*4:y*source.Stride+x*4+4])
+		}
+	}
+
+	return target
+}
+
+// JPEGOrientation reads the orientation tag of the EXIF segment, 1 when
+// there is none
+func JPEGOrientation(data []byte) int {
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return 1
+		}
+
+		marker := data[offset+1]
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+
+		// The image data starts after SOS, metadata comes before it
+		if marker == 0xDA || length < 2 || offset+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		offset += 2 + length
+	}
+
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func TestImagePathJSON(t *testing.T) {
+	cases := []struct {
+		name     string
+		path     ImagePath
+		expected string
+	}{
+		{name: "Empty", path: "", expected: `null`},
+		{name: "Legacy", path: "images/product-1.png", expected: `{"url":"images/product-1.png","thumbnail":"images/product-1.png","card":"images/product-1.png","full":"images/product-1.png"}`},
+		{name: "Resized", path: "images/product-1-full.jpg", expected: `{"url":"images/product-1-full.jpg","thumbnail":"images/product-1-thumbnail.jpg","card":"images/product-1-card.jpg","full":"images/product-1-full.jpg","srcset":"images/product-1-thumbnail.jpg 200w, images/product-1-card.jpg 600w, images/product-1-full.jpg 1600w"}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			encoded, err := json.Marshal(c.path)
+			if err != nil || string(encoded) != c.expected {
+				t.Fatalf("expected %s, got %s (%v)", c.expected, encoded, err)
+			}
+
+			var decoded ImagePath
+			if err = json.Unmarshal(encoded, &decoded); err != nil || decoded != c.path {
+				t.Errorf("expected %q after decoding, got %q (%v)", c.path, decoded, err)
+			}
+		})
+	}
+}
+
+func TestSaveImageFormat(t *testing.T) {
+	if _, err := SaveImage([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), "product"); err != errImageFormat {
+		t.Errorf("expected the format error, got %v", err)
+	}
+
+	// WebP can't be resized without a decoder, so it isn't accepted
+	if _, err := SaveImage([]byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0e\x00\x00\x00\x2f\x00\x00\x00\x00"), "product"); err != errImageFormat {
+		t.Errorf("expected the format error for WebP, got %v", err)
+	}
+
+	if err := CheckImageSize(7000, 10); err != errImageTooLarge {
+		t.Errorf("expected the size error, got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		source.Set(x, 0, color.RGBA{R: 200, A: 255})
+		source.Set(x, 1, color.RGBA{B: 100, A: 255})
+	}
+
+	resized := Resize(source, 2)
+	if resized.Bounds().Dx() != 2 || resized.Bounds().Dy() != 1 {
+		t.Fatalf("unexpected size %v", resized.Bounds())
+	}
+
+	if pixel := resized.RGBAAt(1, 0); pixel != (color.RGBA{R: 100, B: 50, A: 255}) {
+		t.Errorf("unexpected pixel %v", pixel)
+	}
+
+	if Resize(source, 10) != source {
+		t.Error("expected a narrower image to be kept")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	source.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	cases := []struct {
+		orientation int
+		x, y        int
+	}{
+		{orientation: 1, x: 0, y: 0},
+		{orientation: 3, x: 2, y: 1},
+		{orientation: 6, x: 1, y: 0},
+		{orientation: 8, x: 0, y: 2},
+	}
+
+	for _, c := range cases {
+		oriented := Orient(source, c.orientation)
+		if oriented.RGBAAt(c.x, c.y).R != 255 {
+			t.Errorf("orientation %d: expected the corner at %d,%d", c.orientation, c.x, c.y)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	// Big endian TIFF header with one IFD entry, orientation 6
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00")
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	data = append(data, byte((len(segment)+2)>>8), byte(len(segment)+2))
+	data = append(data, segment...)
+	data = append(data, 0xFF, 0xDA, 0x00, 0x02)
+
+	if orientation := JPEGOrientation(data); orientation != 6 {
+		t.Errorf("expected orientation 6, got %d", orientation)
+	}
+
+	if orientation := JPEGOrientation([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}); orientation != 1 {
+		t.Errorf("expected orientation 1, got %d", orientation)
+	}
+}
+
+func TestSaveImage(t *testing.T) {
+	directory, _ := os.Getwd()
+	defer os.Chdir(directory)
+
+	os.Chdir(t.TempDir())
+	os.Mkdir("images", 0755)
+
+	var upload bytes.Buffer
+	png.Encode(&upload, image.NewRGBA(image.Rect(0, 0, 800, 400)))
+
+	path, err := SaveImage(upload.Bytes(), "product")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for name, width := range map[string]int{"thumbnail": 200, "card": 600, "full": 800} {
+		file, err := os.Open(path.Size(name))
+		if err != nil {
+			t.Fatalf("expected the %s size, got %v", name, err)
+		}
+
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+
+		if err != nil || config.Width != width {
+			t.Errorf("expected %s to be %d wide, got %d (%v)", name, width, config.Width, err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reasons of inventory movements
+const (
+	movementSale       = "sale"
+	movementRestock    = "restock"
+	movementAdjustment = "adjustment"
+	movementImport     = "import"
+)
+
+type inventoryLevel struct {
+	Codename  string           `json:"codename"`
+	Name      string           `json:"name"`
+	Unit      string           `json:"unit"`
+	Quantity  decimal.Decimal  `json:"quantity"`
+	Threshold decimal.Decimal  `json:"lowStockThreshold"`
+	Low       bool             `json:"low"`
+	Variants  []ProductVariant `json:"variants"`
+}
+
+type inventoryMovement struct {
+	Product string `json:"product"`
+	InventoryMovement
+}
+
+// ============================= Handlers =============================
+
+// GetInventory shows the stock of the shop's products and the latest
+// movements, optionally of a single product
+func GetInventory(w http.ResponseWriter, r *http.Request) {
+	var shop Shop
+	if err := GetShopByEmail(*GetClaim("email", r), &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "parduotuvė nerasta")
+		return
+	}
+
+	limit, err := ParseLimit(r)
+	if err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Bundles have no stock of their own
+	var products []Product
+	db.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("sku")
+	}).Where("shop_id = ? AND NOT EXISTS (SELECT 1 FROM bundle_items WHERE bundle_items.bundle_id = products.id)", shop.ID).
+		Order("codename").Find(&products)
+
+	levels := make([]inventoryLevel, 0, len(products))
+	for _, product := range products {
+		levels = append(levels, inventoryLevel{
+			Codename:  product.Codename,
+			Name:      *product.Name,
+			Unit:      product.Unit,
+			Quantity:  product.Quantity,
+			Threshold: product.StockThreshold,
+			Low:       IsLowStock(product),
+			Variants:  product.Variants,
+		})
+	}
+
+	tx := db.Select("inventory_movements.*").Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped()
+	}).Joins("JOIN products ON products.id = inventory_movements.product_id").Where("products.shop_id = ?", shop.ID)
+
+	if codename := r.URL.Query().Get("product"); len(codename) > 0 {
+		tx.Where("products.codename = ?", codename)
+	}
+
+	var movements []InventoryMovement
+	tx.Order("inventory_movements.created_at DESC").Limit(limit).Find(&movements)
+
+	recent := make([]inventoryMovement, 0, len(movements))
+	for _, movement := range movements {
+		recent = append(recent, inventoryMovement{movement.Product.Codename, movement})
+	}
+
+	JSONResponse(struct {
+		Products  []inventoryLevel    `json:"products"`
+		Movements []inventoryMovement `json:"movements"`
+	}{levels, recent}, w)
+}
+
+// ============================= Helpers =============================
+
+// RecordMovement adds a stock change to the ledger, changes of zero are skipped
+func RecordMovement(tx *gorm.DB, movement InventoryMovement) error {
+	if movement.Change.IsZero() {
+		return nil
+	}
+
+	return tx.Create(&movement).Error
+}
+
+// RecordSale records an ordered product taken out of stock
+func RecordSale(tx *gorm.DB, line OrderedProduct, plan orderPlan, actorID string) error {
+	movement := InventoryMovement{
+		ProductID:   line.ProductID,
+		VariantID:   line.VariantID,
+		Reason:      movementSale,
+		Change:      line.Quantity.Neg(),
+		ShopOrderID: NullableID(line.ShopOrderID),
+		ActorID:     NullableID(actorID),
+	}
+
+	if line.VariantID != nil {
+		movement.VariantSKU = plan.Variants[*line.VariantID].SKU
+	}
+
+	return RecordMovement(tx, movement)
+}
+
+// RecordStockChanges records the difference between a product's stock
+// before and after an edit. Variants are compared by SKU, since an edit
+// replaces them
+func RecordStockChanges(tx *gorm.DB, before Product, after Product, reason string, actorID string) error {
+	if len(before.BundleItems) > 0 || len(after.BundleItems) > 0 {
+		return nil
+	}
+
+	movement := InventoryMovement{ProductID: after.ID, Reason: reason, ActorID: NullableID(actorID)}
+
+	if len(before.Variants) == 0 && len(after.Variants) == 0 {
+		movement.Change = after.Quantity.Sub(before.Quantity)
+		return RecordMovement(tx, movement)
+	}
+
+	previous := make(map[string]decimal.Decimal)
+	for _, variant := range before.Variants {
+		previous[variant.SKU] = variant.Quantity
+	}
+
+	for _, variant := range after.Variants {
+		variantMovement := movement
+		variantMovement.VariantID = &variant.ID
+		variantMovement.VariantSKU = variant.SKU
+		variantMovement.Change = variant.Quantity.Sub(previous[variant.SKU])
+
+		if err := RecordMovement(tx, variantMovement); err != nil {
+			return err
+		}
+
+		delete(previous, variant.SKU)
+	}
+
+	// Removed variants take their stock with them
+	for sku, quantity := range previous {
+		variantMovement := movement
+		variantMovement.VariantSKU = sku
+		variantMovement.Change = quantity.Neg()
+
+		if err := RecordMovement(tx, variantMovement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestockShopOrder puts the products of a cancelled shop order back in
+// stock. Only the sales in the ledger are restocked and only once.
+// Shop orders that were ever handed over (status 2) are not restocked,
+// the products left the farm
+func RestockShopOrder(shopOrderID string, actorID string) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var shopOrder ShopOrder
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Take(&shopOrder, "id = ?", shopOrderID).Error; err != nil {
+			return err
+		}
+
+		var handedOver int64
+		tx.Model(&StatusChange{}).Where("shop_order_id = ? AND status = ?", shopOrderID, 2).Count(&handedOver)
+		if handedOver > 0 {
+			return nil
+		}
+
+		var restocked int64
+		tx.Model(&InventoryMovement{}).Where("shop_order_id = ? AND reason = ?", shopOrderID, movementRestock).Count(&restocked)
+		if restocked > 0 {
+			return nil
+		}
+
+		var sales []InventoryMovement
+		err := tx.Select("shop_order_id, product_id, variant_sku, SUM(change) AS change").
+			Where("shop_order_id = ? AND reason = ?", shopOrderID, movementSale).
+			Group("shop_order_id, product_id, variant_sku").Find(&sales).Error
+		if err != nil {
+			return err
+		}
+
+		for _, sale := range sales {
+			if err = Restock(tx, sale, actorID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("restocking shop order %s failed: %v", shopOrderID, err)
+	}
+}
+
+// Restock returns a sale to the product, or to the live variant with the
+// sold SKU. Deleted products and variants are not restocked
+func Restock(tx *gorm.DB, sale InventoryMovement, actorID string) error {
+	var product Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&product, "id = ?", sale.ProductID).Error; err != nil {
+		return nil
+	}
+
+	movement := InventoryMovement{
+		ProductID:   product.ID,
+		VariantSKU:  sale.VariantSKU,
+		Reason:      movementRestock,
+		Change:      sale.Change.Neg(),
+		ShopOrderID: sale.ShopOrderID,
+		ActorID:     NullableID(actorID),
+	}
+
+	if len(sale.VariantSKU) > 0 {
+		var variant ProductVariant
+		if err := tx.Take(&variant, "product_id = ? AND sku = ?", product.ID, sale.VariantSKU).Error; err != nil {
+			return nil
+		}
+
+		if err := tx.Model(&variant).Update("quantity", gorm.Expr("quantity + ?", movement.Change)).Error; err != nil {
+			return err
+		}
+
+		movement.VariantID = &variant.ID
+	}
+
+	if err := tx.Model(&product).Update("quantity", gorm.Expr("quantity + ?", movement.Change)).Error; err != nil {
+		return err
+	}
+
+	return RecordMovement(tx, movement)
+}
+
+// IsLowStock tells if the product fell below its threshold, zero turns alerts off
+func IsLowStock(product Product) bool {
+	return product.StockThreshold.IsPositive() && product.Quantity.LessThan(product.StockThreshold)
+}
+
+// NotifyLowStock mails the farmers about products that fell below their
+// threshold. A product is mailed about again only after it was restocked
+func NotifyLowStock() {
+	db.Model(&Product{}).Where("stock_alerted_at IS NOT NULL AND quantity >= stock_threshold").Update("stock_alerted_at", nil)
+
+	var products []Product
+	db.Preload("Shop.User").
+		Where("stock_threshold > 0 AND quantity < stock_threshold AND stock_alerted_at IS NULL").
+		Where("NOT EXISTS (SELECT 1 FROM bundle_items WHERE bundle_items.bundle_id = products.id)").
+		Order("codename").Find(&products)
+
+	shops := make(map[string][]Product)
+	for _, product := range products {
+		shops[product.ShopID] = append(shops[product.ShopID], product)
+	}
+
+	for _, shopProducts := range shops {
+		lines := make([]string, 0, len(shopProducts))
+		ids := make([]string, 0, len(shopProducts))
+
+		for _, product := range shopProducts {
+			lines = append(lines, fmt.Sprintf("%s: liko %s %s (riba %s)", *product.Name, product.Quantity.String(), product.Unit, product.StockThreshold.String()))
+			ids = append(ids, product.ID)
+		}
+
+		owner := shopProducts[0].Shop.User
+		err := SendMail(owner.Email, "Baigiasi produktų likučiai",
+			"Šių produktų likučiai nukrito žemiau nustatytos ribos:\n\n"+strings.Join(lines, "\n"))
+		if err != nil {
+			continue
+		}
+
+		db.Model(&Product{}).Where("id IN ?", ids).Update("stock_alerted_at", time.Now())
+	}
+}
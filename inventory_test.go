@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestIsLowStock(t *testing.T) {
+	cases := []struct {
+		name      string
+		quantity  int64
+		threshold int64
+		low       bool
+	}{
+		{name: "Below", quantity: 2, threshold: 5, low: true},
+		{name: "AtThreshold", quantity: 5, threshold: 5},
+		{name: "Above", quantity: 8, threshold: 5},
+		{name: "AlertsOff", quantity: 0, threshold: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			product := Product{Quantity: decimal.NewFromInt(c.quantity), StockThreshold: decimal.NewFromInt(c.threshold)}
+
+			if IsLowStock(product) != c.low {
+				t.Errorf("expected low stock to be %v", c.low)
+			}
+		})
+	}
+}
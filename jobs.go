@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type job struct {
+	Name     string
+	Interval time.Duration
+	Run      func()
+}
+
+// jobs run in the background of the API process
+var jobs = []job{
+	{"account deletions", time.Hour, ProcessAccountDeletions},
+	{"scheduled publishing", time.Minute, ScheduleProducts},
+	{"subscription orders", time.Hour, GenerateSubscriptionOrders},
+	{"low stock alerts", 10 * time.Minute, NotifyLowStock},
+}
+
+func (a *app) StartJobs() *app {
+	for _, j := range jobs {
+		go RunJob(j)
+	}
+
+	return a
+}
+
+func RunJob(j job) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+
+	for {
+		func() {
+			// A failing job must not take down the API
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("job %s failed: %v", j.Name, err)
+				}
+			}()
+
+			j.Run()
+		}()
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Tokens are signed with asymmetric keys loaded from JWT_KEY_DIR.
+// Every "<kid>.pem" file in the directory holds a PKCS#8 (or PKCS#1 RSA)
+// private key, the file name without extension becomes the "kid" header.
+//
+// Every key has an activation time, the "Activate-At" PEM header (RFC 3339)
+// or, without it, jwksMaxAge after the file was last modified. A key is
+// published in the JWKS right away, but only signs once it is active, so
+// clients that cached the JWKS already know it. The most recently
+// activated key signs new tokens. Older keys are retired when a newer key
+// activates and keep validating tokens until the longest lived token
+// signed with them (refresh token) has expired.
+//
+// Rotation:
+//  1. generate a new key, e.g. `openssl genpkey -algorithm ed25519 -out keys/2022-01.pem`
+//  2. restart the API, the new key is published in the JWKS and starts
+//     signing once it activates
+//  3. remove the old key file once refreshTokenLifetime has passed
+//
+// When JWT_KEY_DIR is empty tokens are signed with HS256 and JWT_SECRET.
+
+type signingKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.PrivateKey
+	Public    crypto.PublicKey
+	ActiveAt  time.Time
+	RetiredAt *time.Time
+}
+
+// jwksMaxAge is how long clients may cache the JWKS
+const jwksMaxAge = time.Minute * 5
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// keyRing is sorted by activation time, newest first
+var keyRing []signingKey
+
+// =========================== Handlers ===================================
+
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := make([]JWK, 0)
+
+	for _, key := range ActiveKeys(time.Now()) {
+		keys = append(keys, key.JWK())
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	JSONResponse(struct {
+		Keys []JWK `json:"keys"`
+	}{keys}, w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func LoadSigningKeys(dir string) error {
+	keyRing = nil
+
+	if len(dir) == 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		key, err := ReadSigningKey(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		keyRing = append(keyRing, key)
+	}
+
+	if len(keyRing) == 0 {
+		return errors.New("no signing keys found in " + dir)
+	}
+
+	sort.Slice(keyRing, func(i, j int) bool {
+		return keyRing[i].ActiveAt.After(keyRing[j].ActiveAt)
+	})
+
+	// Every key is retired by the key that activates after it
+	for i := 1; i < len(keyRing); i++ {
+		retiredAt := keyRing[i-1].ActiveAt
+		keyRing[i].RetiredAt = &retiredAt
+	}
+
+	return nil
+}
+
+func ReadSigningKey(file string) (signingKey, error) {
+	key := signingKey{
+		ID: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return key, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return key, errors.New("invalid PEM")
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return key, err
+	}
+
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Private = private
+		key.Public = &private.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Private = private
+		key.Public = private.Public()
+	default:
+		return key, errors.New("only RSA and Ed25519 keys are supported")
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return key, err
+	}
+
+	key.ActiveAt = info.ModTime().Add(jwksMaxAge)
+	if activateAt, ok := block.Headers["Activate-At"]; ok {
+		if key.ActiveAt, err = time.Parse(time.RFC3339, activateAt); err != nil {
+			return key, fmt.Errorf("invalid Activate-At: %w", err)
+		}
+	}
+
+	return key, nil
+}
+
+// SigningKey returns the most recently activated key. Until any key
+// is active, e.g. on the first start, the earliest one signs, no client
+// could have cached a JWKS without it
+func SigningKey(now time.Time) signingKey {
+	for _, key := range keyRing {
+		if !key.ActiveAt.After(now) {
+			return key
+		}
+	}
+
+	return keyRing[len(keyRing)-1]
+}
+
+// ActiveKeys returns the keys that can still verify tokens, including
+// the ones waiting to activate
+func ActiveKeys(now time.Time) []signingKey {
+	keys := make([]signingKey, 0, len(keyRing))
+
+	for _, key := range keyRing {
+		if key.RetiredAt == nil || key.RetiredAt.Add(refreshTokenLifetime).After(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func FindVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range ActiveKeys(time.Now()) {
+		if key.ID == kid && key.Method.Alg() == token.Method.Alg() {
+			return key.Public, nil
+		}
+	}
+
+	return nil, fmt.Errorf("įvyko klaida, bandykite dar kartą")
+}
+
+// ParseToken verifies a token signed by GenerateToken
+func ParseToken(tokenString string, claims jwt.MapClaims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if len(keyRing) > 0 {
+			return FindVerificationKey(token)
+		}
+
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("įvyko klaida, bandykite dar kartą")
+		}
+		return signKey, nil
+	})
+}
+
+func (key signingKey) JWK() JWK {
+	jwk := JWK{
+		Kid: key.ID,
+		Use: "sig",
+		Alg: key.Method.Alg(),
+	}
+
+	switch public := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func WriteTestKey(t *testing.T, dir string, kid string, modTime time.Time) {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+
+	file := filepath.Join(dir, kid+".pem")
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Chtimes(file, modTime, modTime)
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Cleanup(func() {
+		LoadSigningKeys("")
+	})
+
+	WriteTestKey(t, dir, "old", time.Now().Add(-time.Hour))
+
+	if err := LoadSigningKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken, _ := GenerateToken(map[string]interface{}{"email": "test@email.com"})
+
+	WriteTestKey(t, dir, "new", time.Now())
+
+	if err := LoadSigningKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is published first and only signs once cached JWKS expire
+	if len(ActiveKeys(time.Now())) != 2 {
+		t.Error("both keys should be published")
+	}
+
+	if key := SigningKey(time.Now()); key.ID != "old" {
+		t.Errorf("expected old key to sign until the new one activates, got %s", key.ID)
+	}
+
+	if key := SigningKey(time.Now().Add(jwksMaxAge + time.Second)); key.ID != "new" {
+		t.Errorf("expected new key to sign once active, got %s", key.ID)
+	}
+
+	WriteTestKey(t, dir, "new", time.Now().Add(-jwksMaxAge-time.Minute))
+
+	if err := LoadSigningKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, _ := GenerateToken(map[string]interface{}{"email": "test@email.com"})
+
+	token, err := ParseToken(newToken, jwt.MapClaims{})
+	if err != nil || token.Header["kid"] != "new" {
+		t.Errorf("expected token signed with new key, got %v %v", token.Header["kid"], err)
+	}
+
+	if _, err = ParseToken(oldToken, jwt.MapClaims{}); err != nil {
+		t.Errorf("token signed with retired key should still validate: %v", err)
+	}
+
+	// Retired key is dropped once every token it signed has expired
+	if len(ActiveKeys(time.Now().Add(refreshTokenLifetime+time.Minute))) != 1 {
+		t.Error("retired key should expire")
+	}
+
+	if jwk := keyRing[0].JWK(); jwk.Kty != "OKP" || jwk.Kid != "new" || len(jwk.X) == 0 {
+		t.Errorf("bad JWK %+v", jwk)
+	}
+}
+
+func TestSigningKeyActivateAt(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Cleanup(func() {
+		LoadSigningKeys("")
+	})
+
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	activateAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	block := &pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{"Activate-At": activateAt.Format(time.RFC3339)}, Bytes: der}
+	if err := ioutil.WriteFile(filepath.Join(dir, "scheduled.pem"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadSigningKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !keyRing[0].ActiveAt.Equal(activateAt) {
+		t.Errorf("expected activation at %v, got %v", activateAt, keyRing[0].ActiveAt)
+	}
+
+	// The only key signs even before it activates
+	if key := SigningKey(time.Now()); key.ID != "scheduled" {
+		t.Errorf("expected the only key to sign, got %s", key.ID)
+	}
+}
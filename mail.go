@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// SendMail sends a plain text email through SMTP_HOST. Without SMTP
+// configured the message is only logged, which is enough for development.
+// Bodies carry single use tokens, they are only logged with MAIL_DEBUG=true
+func SendMail(to string, subject string, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	from := os.Getenv("MAIL_FROM")
+
+	if len(host) == 0 {
+		if os.Getenv("MAIL_DEBUG") == "true" {
+			log.Printf("mail to %s: %s\n%s", to, subject, body)
+		} else {
+			log.Printf("mail to %s: %s", to, subject)
+		}
+
+		return nil
+	}
+
+	message := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); len(username) > 0 {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	address := fmt.Sprintf("%s:%s", host, os.Getenv("SMTP_PORT"))
+	return smtp.SendMail(address, auth, from, []string{to}, []byte(message))
+}
+
+// FrontendLink builds a link to a frontend page
+func FrontendLink(path string) string {
+	return strings.TrimSuffix(os.Getenv("FRONTEND_URL"), "/") + path
+}
@@ -42,6 +42,10 @@ func (a *app) InitDB(env string) *app {
 	}
 
 	signKey = []byte(os.Getenv("JWT_SECRET"))
+	if err = LoadSigningKeys(os.Getenv("JWT_KEY_DIR")); err != nil {
+		log.Fatal(err)
+	}
+
 	passwordRegex = regexp.MustCompile(`([A-Z].*=?)([0-9].*=?)|([0-9].*=?)([A-Z].*=?)`)
 	emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
@@ -56,7 +60,28 @@ func (a *app) InitDB(env string) *app {
 	}
 
 	db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"")
-	db.AutoMigrate(&User{}, &Category{}, &Shop{}, &Location{}, &Product{}, &RefreshToken{}, &OrderedProduct{}, &Order{}, &ShopOrder{})
+	MigrateDecimalColumns(db)
+	db.AutoMigrate(&User{}, &Category{}, &Shop{}, &Location{}, &Product{}, &RefreshToken{}, &OrderedProduct{}, &Order{}, &ShopOrder{}, &RecoveryCode{}, &TwoFactorPolicy{}, &ApiKey{}, &RateLimitCounter{}, &AuditEvent{}, &OidcIdentity{}, &VerificationToken{}, &StatusChange{}, &ProductRevision{}, &ProductVariant{}, &BundleItem{}, &SubscriptionPlan{}, &SubscriptionPlanItem{}, &Subscription{}, &SubscriptionCycle{}, &InventoryMovement{})
+
+	if err = MigrateProductRevisions(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = db.Exec(auditAppendOnlySQL).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	if err = db.Exec(productSearchSetupSQL).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	RefreshProductSearch("search_vector IS NULL")
+
+	if err = db.Exec(geoSetupSQL).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	InitRateLimitStore()
 
 	a.DB = db
 	return a
@@ -67,5 +92,5 @@ func NewApp() *app {
 }
 
 func main() {
-	NewApp().InitRouter().InitDB(".env").Start()
+	NewApp().InitRouter().InitDB(".env").StartJobs().Start()
 }
@@ -16,39 +16,100 @@ type User struct {
 	Email        string    `json:"email" gorm:"size:100;not null;index"`
 	Password     string    `json:"-" gorm:"size:100;not null"`
 	Salt         string    `json:"-" gorm:"size:64;not null"`
+	NoPassword   bool      `json:"-"` // Signed up through OIDC, the password was never set
 	Permissions  string    `json:"-" gorm:"size:20"`
 	ShopCodename *string   `json:"-"`
 	Temporary    bool      `json:"temporary"`
+
+	TwoFactorSecret  string `json:"-" gorm:"size:64"`
+	TwoFactorEnabled bool   `json:"twoFactorEnabled"`
+	TOTPLastStep     int64  `json:"-"` // Time step of the last accepted code, codes can't be used twice
+
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+
+	DeletionScheduledAt *time.Time `json:"-" gorm:"index"`
+	SuspendedAt         *time.Time `json:"-"`
 }
 
 type Shop struct {
-	ID          string     `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
-	CreatedAt   time.Time  `json:"-"`
-	Name        *string    `json:"name" gorm:"size:100;not null"`
-	Address     *string    `json:"address" gorm:"size:100"`
-	Codename    string     `json:"codename" gorm:"size:100;not null;index"`
-	Description *string    `json:"description" gorm:"default:''"`
-	User        User       `json:"-" gorm:"not null"`
-	UserID      string     `json:"-"`
-	Locations   []Location `json:"locations" gorm:"constraint:OnDelete:CASCADE;"`
-	Products    []Product  `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	ID          string         `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt   time.Time      `json:"-"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+	Name        *string        `json:"name" gorm:"size:100;not null"`
+	Address     *string        `json:"address" gorm:"size:100"`
+	Codename    string         `json:"codename" gorm:"size:100;not null;index"`
+	Description *string        `json:"description" gorm:"default:''"`
+	User        User           `json:"-" gorm:"not null"`
+	UserID      string         `json:"-"`
+	Locations   []Location     `json:"locations" gorm:"constraint:OnDelete:CASCADE;"`
+	Products    []Product      `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	Distance    *float64       `json:"distance,omitempty" gorm:"->;-:migration"`
 }
 
+// Product.Price is per Unit. Products priced by weight get their final
+// total once the farmer enters the actual weight in the shop order
 type Product struct {
-	ID            string          `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
-	CreatedAt     time.Time       `json:"-"`
-	DeletedAt     gorm.DeletedAt  `json:"-" gorm:"index"`
-	Name          *string         `json:"name" gorm:"size:100;not null"`
-	Codename      string          `json:"codename" gorm:"size:100;not null;index"`
-	Description   *string         `json:"description"gorm:"default:''"`
-	Image         string          `json:"image" gorm:"size:500"`
-	Price         decimal.Decimal `json:"price" sql:"type:decimal(20,8);"  gorm:"not null"`
-	Public        bool            `json:"public"`
-	Quantity      int             `json:"quantity" gorm:"not null"`
-	BaseProductID *string         `json:"baseProductId" gorm:"default:null;size:40"`
-	Shop          Shop            `json:"shop" gorm:"not null"`
-	ShopID        string          `json:"-" gorm:"not null"`
-	Categories    []Category      `json:"categories" gorm:"many2many:product_categories;constraint:OnDelete:CASCADE;"`
+	ID             string           `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt      time.Time        `json:"-"`
+	DeletedAt      gorm.DeletedAt   `json:"-" gorm:"index"`
+	Name           *string          `json:"name" gorm:"size:100;not null"`
+	Codename       string           `json:"codename" gorm:"size:100;not null;index"`
+	SKU            string           `json:"sku" gorm:"size:64;index"`
+	Description    *string          `json:"description"gorm:"default:''"`
+	Image          ImagePath        `json:"image" gorm:"size:500"`
+	Price          decimal.Decimal  `json:"price" gorm:"type:numeric;not null"`
+	Public         bool             `json:"public"`
+	Quantity       decimal.Decimal  `json:"quantity" gorm:"type:numeric;not null"`
+	Unit           string           `json:"unit" gorm:"size:10;not null;default:vnt"`
+	Step           decimal.Decimal  `json:"step" gorm:"type:numeric;not null;default:1"`
+	PricedByWeight bool             `json:"pricedByWeight"`
+	PublishAt      *time.Time       `json:"publishAt"`
+	UnpublishAt    *time.Time       `json:"unpublishAt"`
+	AvailableFrom  *time.Time       `json:"availableFrom"`
+	AvailableUntil *time.Time       `json:"availableUntil"`
+	StockThreshold decimal.Decimal  `json:"lowStockThreshold" gorm:"type:numeric;not null;default:0"`
+	StockAlertedAt *time.Time       `json:"-"`
+	Availability   string           `json:"availability" gorm:"-"`
+	RevisionID     *string          `json:"revisionId" gorm:"size:40"`
+	Shop           Shop             `json:"shop" gorm:"not null"`
+	ShopID         string           `json:"-" gorm:"not null"`
+	Categories     []Category       `json:"categories" gorm:"many2many:product_categories;constraint:OnDelete:CASCADE;"`
+	Variants       []ProductVariant `json:"variants"`
+	BundleItems    []BundleItem     `json:"bundleItems" gorm:"foreignKey:BundleID"`
+	Distance       *float64         `json:"distance,omitempty" gorm:"->;-:migration"`
+}
+
+// ProductRevision is an immutable snapshot of what a product was sold
+// as. Every product edit adds a revision, ordered products point to the
+// revision that was bought
+type ProductRevision struct {
+	ID             string          `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	ProductID      string          `json:"-" gorm:"size:40;not null;uniqueIndex:idx_product_revision"`
+	Number         int             `json:"number" gorm:"not null;uniqueIndex:idx_product_revision"`
+	Name           string          `json:"name" gorm:"size:100;not null"`
+	Description    string          `json:"description"`
+	Image          ImagePath       `json:"image" gorm:"size:500"`
+	Price          decimal.Decimal `json:"price" gorm:"type:numeric;not null"`
+	Unit           string          `json:"unit" gorm:"size:10;not null"`
+	Step           decimal.Decimal `json:"step" gorm:"type:numeric;not null"`
+	PricedByWeight bool            `json:"pricedByWeight"`
+}
+
+// ProductVariant is a sellable version of a product with its own price
+// and stock. Every product edit creates new variant rows and soft
+// deletes the old ones, so ordered variants keep their old values
+type ProductVariant struct {
+	ID        string          `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt time.Time       `json:"-"`
+	DeletedAt gorm.DeletedAt  `json:"-" gorm:"index"`
+	ProductID string          `json:"-" gorm:"size:40;not null;index"`
+	SKU       string          `json:"sku" gorm:"size:64;not null;index"`
+	Options   VariantOptions  `json:"options" gorm:"type:jsonb"`
+	Price     decimal.Decimal `json:"price" gorm:"type:numeric;not null"`
+	Quantity  decimal.Decimal `json:"quantity" gorm:"type:numeric;not null"`
+	Image     ImagePath       `json:"image" gorm:"size:500"`
 }
 
 type Location struct {
@@ -72,11 +133,12 @@ type Order struct {
 	PaymentType     int              `json:"paymentType"`
 	OrderedProducts []OrderedProduct `json:"orderedProducts"`
 	ShopOrders      []ShopOrder      `json:"shopOrders"`
-	TotalPrice      decimal.Decimal  `json:"totalPrice"`
+	TotalPrice      decimal.Decimal  `json:"totalPrice" gorm:"type:numeric"`
 	DeliveredBy     string           `json:"-" gorm:"size:40"`
 	Deliverer       User             `json:"deliverer" gorm:"foreignKey:DeliveredBy"`
 	PickupDate      *time.Time       `json:"pickupDate"`
 	CancelIfMissing bool             `json:"cancelIfMissing"`
+	History         []StatusChange   `json:"history"`
 }
 
 type ShopOrder struct {
@@ -91,18 +153,53 @@ type ShopOrder struct {
 	CollectedBy     string           `json:"-" gorm:"size:40"`
 	Collector       User             `json:"collector" gorm:"foreignKey:CollectedBy"`
 	OrderedProducts []OrderedProduct `json:"orderedProducts"`
+	History         []StatusChange   `json:"history"`
 }
 
-type OrderedProduct struct {
+// StatusChange is a single transition of an order or a shop order,
+// exactly one of OrderID and ShopOrderID is set
+type StatusChange struct {
 	ID          string    `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
-	CreatedAt   time.Time `json:"-"`
-	Order       Order     `json:"order" gorm:"not null"`
-	OrderID     string    `json:"-" gorm:"not null"`
-	ShopOrder   ShopOrder `json:"shopOrder" gorm:"not null"`
-	ShopOrderID string    `json:"-"`
-	Product     Product   `json:"product" gorm:"not null"`
-	ProductID   string    `json:"-" gorm:"not null"`
-	Quantity    int       `json:"quantity" gorm:"not null"`
+	CreatedAt   time.Time `json:"createdAt"`
+	OrderID     *string   `json:"-" gorm:"size:40;index"`
+	ShopOrderID *string   `json:"-" gorm:"size:40;index"`
+	Status      int       `json:"status" gorm:"not null"`
+	Message     string    `json:"message" gorm:"size:150"`
+	ActorID     *string   `json:"-" gorm:"size:40"`
+	Actor       *User     `json:"actor" gorm:"foreignKey:ActorID"`
+}
+
+// BundleItem is a component of a bundle product, found by codename
+// like the items of subscription plans
+type BundleItem struct {
+	ID                string          `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	BundleID          string          `json:"-" gorm:"size:40;not null;index"`
+	ComponentCodename string          `json:"product" gorm:"size:100;not null"`
+	VariantSKU        string          `json:"variant" gorm:"size:64"`
+	Quantity          decimal.Decimal `json:"quantity" gorm:"type:numeric;not null"`
+}
+
+// OrderedProduct.ActualQuantity is the weight entered by the farmer
+// for products priced by weight. Bundles are ordered as a line with
+// the bundle's price and component lines pointing to it through
+// BundleLineID, the component lines are not priced
+type OrderedProduct struct {
+	ID             string           `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt      time.Time        `json:"-"`
+	Order          Order            `json:"order" gorm:"not null"`
+	OrderID        string           `json:"-" gorm:"not null"`
+	ShopOrder      ShopOrder        `json:"shopOrder" gorm:"not null"`
+	ShopOrderID    string           `json:"-"`
+	Product        Product          `json:"product" gorm:"not null"`
+	ProductID      string           `json:"-" gorm:"not null"`
+	Variant        *ProductVariant  `json:"variant"`
+	VariantID      *string          `json:"-" gorm:"size:40"`
+	Revision       *ProductRevision `json:"revision"`
+	RevisionID     *string          `json:"-" gorm:"size:40;index"`
+	Quantity       decimal.Decimal  `json:"quantity" gorm:"type:numeric;not null"`
+	ActualQuantity *decimal.Decimal `json:"actualQuantity" gorm:"type:numeric"`
+	BundleLineID   *string          `json:"bundleLineId" gorm:"size:40;index"`
+	Components     []OrderedProduct `json:"-" gorm:"foreignKey:BundleLineID"`
 }
 
 type Category struct {
@@ -110,7 +207,7 @@ type Category struct {
 	CreatedAt time.Time `json:"-"`
 	Name      *string   `json:"name" gorm:"size:100;not null"`
 	Codename  string    `json:"codename" gorm:"size:100;not null"`
-	File      string    `json:"file" gorm:"size:500"`
+	File      ImagePath `json:"file" gorm:"size:500"`
 	Products  []Product `json:"-" gorm:"many2many:product_categories;constraint:OnDelete:CASCADE;"`
 }
 
@@ -122,7 +219,140 @@ type RefreshToken struct {
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+type RecoveryCode struct {
+	ID        string     `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt time.Time  `json:"-"`
+	User      User       `json:"-" gorm:"not null"`
+	UserID    string     `json:"-" gorm:"not null;index"`
+	Code      string     `json:"-" gorm:"size:100;not null"`
+	UsedAt    *time.Time `json:"-"`
+}
+
+type TwoFactorPolicy struct {
+	Role     string `json:"role" gorm:"primary_key;size:1"`
+	Required bool   `json:"required"`
+}
+
+type ApiKey struct {
+	ID         string     `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Name       string     `json:"name" gorm:"size:100;not null"`
+	Prefix     string     `json:"prefix" gorm:"size:20;not null;uniqueIndex"`
+	Hash       string     `json:"-" gorm:"size:64;not null"`
+	Scopes     string     `json:"scopes" gorm:"size:200;not null"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	SteppedUp  bool       `json:"-"` // The creating session proved a second factor
+	Shop       Shop       `json:"-" gorm:"not null"`
+	ShopID     string     `json:"-" gorm:"not null;index"`
+}
+
+type RateLimitCounter struct {
+	Key     string    `gorm:"primary_key;size:200"`
+	Count   int       `gorm:"not null"`
+	ResetAt time.Time `gorm:"not null;index"`
+}
+
+type AuditEvent struct {
+	ID         string       `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt  time.Time    `json:"createdAt" gorm:"index"`
+	ActorID    string       `json:"actorId" gorm:"size:40;index"`
+	Action     string       `json:"action" gorm:"size:50;not null;index"`
+	EntityType string       `json:"entityType" gorm:"size:30;not null"`
+	EntityID   string       `json:"entityId" gorm:"size:100;index"`
+	Changes    AuditChanges `json:"changes" gorm:"type:jsonb"`
+	IP         string       `json:"ip" gorm:"size:50"`
+}
+
+type OidcIdentity struct {
+	ID        string    `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt time.Time `json:"-"`
+	Provider  string    `json:"provider" gorm:"size:50;not null;uniqueIndex:idx_oidc_subject"`
+	Subject   string    `json:"-" gorm:"size:255;not null;uniqueIndex:idx_oidc_subject"`
+	User      User      `json:"-" gorm:"not null"`
+	UserID    string    `json:"-" gorm:"not null;index"`
+}
+
+type VerificationToken struct {
+	ID        string     `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt time.Time  `json:"-"`
+	Email     string     `json:"-" gorm:"size:100;not null;index"`
+	Purpose   string     `json:"-" gorm:"size:30;not null"`
+	Hash      string     `json:"-" gorm:"size:64;not null;uniqueIndex"`
+	Payload   string     `json:"-" gorm:"size:100"`
+	ExpiresAt time.Time  `json:"-" gorm:"not null"`
+	UsedAt    *time.Time `json:"-"`
+}
+
+// SubscriptionPlan is a recurring box a shop sells, e.g. a weekly
+// vegetable box. Items refer to products by codename like orders do
+type SubscriptionPlan struct {
+	ID          string                 `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt   time.Time              `json:"-"`
+	Name        string                 `json:"name" gorm:"size:100;not null"`
+	Description string                 `json:"description"`
+	Frequency   int                    `json:"frequency" gorm:"not null"`
+	Price       decimal.Decimal        `json:"price" gorm:"type:numeric;not null"`
+	Active      bool                   `json:"active" gorm:"not null;default:true"`
+	Shop        Shop                   `json:"shop" gorm:"not null"`
+	ShopID      string                 `json:"-" gorm:"not null;index"`
+	Items       []SubscriptionPlanItem `json:"items" gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE;"`
+}
+
+type SubscriptionPlanItem struct {
+	ID              string          `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	PlanID          string          `json:"-" gorm:"size:40;not null;index"`
+	ProductCodename string          `json:"product" gorm:"size:100;not null"`
+	VariantSKU      string          `json:"variant" gorm:"size:64"`
+	Quantity        decimal.Decimal `json:"quantity" gorm:"type:numeric;not null"`
+}
+
+// Subscription statuses: 1 active, 2 paused, 3 cancelled. NextDelivery
+// is the date of the next cycle that gets an order
+type Subscription struct {
+	ID           string              `json:"id" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	Plan         SubscriptionPlan    `json:"plan" gorm:"not null"`
+	PlanID       string              `json:"-" gorm:"size:40;not null;index"`
+	User         User                `json:"-" gorm:"not null"`
+	UserID       string              `json:"-" gorm:"size:40;not null;index"`
+	Status       int                 `json:"status" gorm:"not null;index"`
+	Address      string              `json:"address" gorm:"not null"`
+	PaymentType  int                 `json:"paymentType"`
+	Note         string              `json:"note" gorm:"size:100;not null"`
+	NextDelivery time.Time           `json:"nextDelivery" gorm:"type:date;not null;index"`
+	PausedUntil  *time.Time          `json:"pausedUntil" gorm:"type:date"`
+	Cycles       []SubscriptionCycle `json:"cycles"`
+}
+
+// SubscriptionCycle records what happened to one delivery date of a
+// subscription. The unique index makes order generation idempotent
+type SubscriptionCycle struct {
+	ID             string    `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt      time.Time `json:"-"`
+	SubscriptionID string    `json:"-" gorm:"size:40;not null;uniqueIndex:idx_subscription_cycle"`
+	Date           time.Time `json:"date" gorm:"type:date;not null;uniqueIndex:idx_subscription_cycle"`
+	Skipped        bool      `json:"skipped"`
+	Order          *Order    `json:"order,omitempty"`
+	OrderID        *string   `json:"-" gorm:"size:40"`
+	Error          string    `json:"error,omitempty" gorm:"size:500"`
+}
+
 type ErrorJSON struct {
 	Message string      `json:"message,omitempty"`
 	Payload interface{} `json:"payload,omitempty"`
 }
+
+// InventoryMovement is a change of a product's or a variant's stock
+type InventoryMovement struct {
+	ID          string          `json:"-" gorm:"primary_key;size:40;default:uuid_generate_v4()"`
+	CreatedAt   time.Time       `json:"createdAt" gorm:"index"`
+	Product     Product         `json:"-"`
+	ProductID   string          `json:"-" gorm:"size:40;not null;index"`
+	VariantID   *string         `json:"-" gorm:"size:40"`
+	VariantSKU  string          `json:"variant,omitempty" gorm:"size:64"`
+	Reason      string          `json:"reason" gorm:"size:20;not null"`
+	Change      decimal.Decimal `json:"change" gorm:"type:numeric;not null"`
+	ShopOrderID *string         `json:"-" gorm:"size:40;index"`
+	ActorID     *string         `json:"-" gorm:"size:40"`
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// OIDC providers are configured through env:
+//
+//	OIDC_PROVIDERS=google,facebook
+//	OIDC_GOOGLE_ISSUER=https://accounts.google.com
+//	OIDC_GOOGLE_CLIENT_ID=...
+//	OIDC_GOOGLE_CLIENT_SECRET=...
+//	OIDC_GOOGLE_REDIRECT_URL=https://api.example.com/oidc/google/callback
+//
+// OIDC_SUCCESS_REDIRECT is the frontend page users land on after logging in.
+
+type oidcProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+
+	keys      map[string]interface{}
+	keysMutex sync.Mutex
+}
+
+var oidcProviders = make(map[string]*oidcProvider)
+var oidcProvidersMutex sync.Mutex
+
+var oidcClient = &http.Client{Timeout: time.Second * 10}
+
+const oidcStateCookie = "Oidc-State"
+
+// The 2FA challenge of a redirected login is kept out of the URL
+const challengeCookie = "Two-Factor-Challenge"
+
+// =========================== Handlers ===================================
+
+// OidcLogin redirects the user to the provider with a fresh state,
+// nonce and PKCE verifier kept in a signed cookie
+func OidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := GetOidcProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		Response(w, http.StatusNotFound, "toks prisijungimo būdas nepalaikomas")
+		return
+	}
+
+	state, nonce, verifier := RandomString(), RandomString(), RandomString()
+
+	cookie, err := GenerateToken(map[string]interface{}{
+		"purpose":  "oidc",
+		"provider": provider.Name,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(time.Minute * 10).Unix(),
+	})
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida. bandykite dar kartą")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: cookie, HttpOnly: true, MaxAge: 600, Path: "/oidc"})
+
+	http.Redirect(w, r, provider.AuthorizationURL(state, nonce, verifier), http.StatusFound)
+}
+
+func OidcCallback(w http.ResponseWriter, r *http.Request) {
+	errorMSG := "nepavyko prisijungti"
+
+	provider, err := GetOidcProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		Response(w, http.StatusNotFound, "toks prisijungimo būdas nepalaikomas")
+		return
+	}
+
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		Response(w, http.StatusBadRequest, errorMSG)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", MaxAge: -1, Path: "/oidc"})
+
+	session := jwt.MapClaims{}
+	token, err := ParseToken(stateCookie.Value, session)
+	if err != nil || !token.Valid || session["purpose"] != "oidc" || session["provider"] != provider.Name {
+		Response(w, http.StatusBadRequest, errorMSG)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if subtle.ConstantTimeCompare([]byte(state), []byte(ToString(session["state"]))) != 1 {
+		Response(w, http.StatusBadRequest, errorMSG)
+		return
+	}
+
+	if len(r.URL.Query().Get("error")) > 0 {
+		Response(w, http.StatusUnauthorized, errorMSG)
+		return
+	}
+
+	idToken, err := provider.ExchangeCode(r.URL.Query().Get("code"), ToString(session["verifier"]))
+	if err != nil {
+		Response(w, http.StatusUnauthorized, errorMSG)
+		return
+	}
+
+	claims, err := provider.VerifyIDToken(idToken, ToString(session["nonce"]))
+	if err != nil {
+		Response(w, http.StatusUnauthorized, errorMSG)
+		return
+	}
+
+	user, err := FindOrCreateOidcUser(provider.Name, claims)
+	if err != nil {
+		Response(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	if IsLocked(user) {
+		TooManyRequests(w, *user.LockedUntil, "paskyra laikinai užrakinta. bandykite vėliau")
+		return
+	}
+
+	if IsSuspended(user) {
+		Response(w, http.StatusForbidden, "paskyra sustabdyta")
+		return
+	}
+
+	redirect := os.Getenv("OIDC_SUCCESS_REDIRECT")
+
+	// Social login replaces the password, not the second factor
+	if user.TwoFactorEnabled {
+		challenge, _ := GenerateChallengeToken(user)
+
+		if len(redirect) > 0 {
+			http.SetCookie(w, &http.Cookie{Name: challengeCookie, Value: challenge, HttpOnly: true, MaxAge: 300, Path: "/login/2fa"})
+			http.Redirect(w, r, redirect+"?twoFactor=true", http.StatusFound)
+			return
+		}
+
+		JSONResponse(struct {
+			TwoFactorRequired bool   `json:"twoFactorRequired"`
+			Challenge         string `json:"challenge"`
+		}{true, challenge}, w)
+		return
+	}
+
+	WriteAuditAs(r, user.ID, "user.login", "user", user.ID)
+	accessToken, _ := MakeTokens(w, user)
+
+	if len(redirect) > 0 {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(struct {
+		AccessToken string `json:"accessToken"`
+	}{accessToken}, w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+// GetOidcProvider reads the provider configuration from env and
+// fetches its discovery document the first time it is used. The
+// document is fetched without holding the lock, so a slow provider
+// doesn't block logins through the others
+func GetOidcProvider(name string) (*oidcProvider, error) {
+	name = strings.ToLower(name)
+
+	oidcProvidersMutex.Lock()
+	provider, ok := oidcProviders[name]
+	oidcProvidersMutex.Unlock()
+
+	if ok {
+		return provider, nil
+	}
+
+	enabled := false
+	for _, providerName := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		if strings.TrimSpace(strings.ToLower(providerName)) == name && len(name) > 0 {
+			enabled = true
+		}
+	}
+
+	if !enabled {
+		return nil, errors.New("provider not configured")
+	}
+
+	prefix := "OIDC_" + strings.ToUpper(name) + "_"
+	provider = &oidcProvider{
+		Name:         name,
+		Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+	}
+
+	response, err := oidcClient.Get(provider.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %d", response.StatusCode)
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(provider); err != nil {
+		return nil, err
+	}
+
+	oidcProvidersMutex.Lock()
+	defer oidcProvidersMutex.Unlock()
+
+	// Another request may have fetched it in the meantime
+	if existing, ok := oidcProviders[name]; ok {
+		return existing, nil
+	}
+
+	oidcProviders[name] = provider
+	return provider, nil
+}
+
+func (p *oidcProvider) AuthorizationURL(state string, nonce string, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// ExchangeCode trades the authorization code for an ID token
+func (p *oidcProvider) ExchangeCode(code string, verifier string) (string, error) {
+	if len(code) == 0 {
+		return "", errors.New("missing code")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	response, err := oidcClient.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{""}
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d", response.StatusCode)
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	if len(tokens.IDToken) == 0 {
+		return "", errors.New("missing id_token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce
+func (p *oidcProvider) VerifyIDToken(idToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.New("unexpected signing method")
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.PublicKey(kid)
+	})
+
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid id_token")
+	}
+
+	if claims["iss"] != p.Issuer {
+		return nil, errors.New("invalid issuer")
+	}
+
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("invalid audience")
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("missing exp")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(ToString(claims["nonce"])), []byte(nonce)) != 1 {
+		return nil, errors.New("invalid nonce")
+	}
+
+	return claims, nil
+}
+
+// PublicKey finds the provider key, refetching the JWKS once
+// when the key is unknown as the provider may have rotated keys
+func (p *oidcProvider) PublicKey(kid string) (interface{}, error) {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	keys, err := FetchJWKS(p.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.New("unknown key")
+}
+
+func FetchJWKS(uri string) (map[string]interface{}, error) {
+	response, err := oidcClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	jwks := struct {
+		Keys []JWK `json:"keys"`
+	}{nil}
+
+	if err = json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (jwk JWK) PublicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, errors.New("unsupported key type")
+}
+
+// FindOrCreateOidcUser returns the user linked to the provider subject.
+// Users are linked by verified email on first login, or created
+func FindOrCreateOidcUser(provider string, claims jwt.MapClaims) (User, error) {
+	var user User
+
+	subject := ToString(claims["sub"])
+	if len(subject) == 0 {
+		return user, errors.New("nepavyko prisijungti")
+	}
+
+	var identity OidcIdentity
+	if db.Take(&identity, "provider = ? AND subject = ?", provider, subject).Error == nil {
+		err := db.Take(&user, "id = ?", identity.UserID).Error
+		return user, err
+	}
+
+	email := ToString(claims["email"])
+	if verified, _ := claims["email_verified"].(bool); !verified || !emailRegex.MatchString(email) {
+		return user, errors.New("el.pašto adresas nepatvirtintas")
+	}
+
+	err := db.Take(&user, "email = ?", email).Error
+	if err != nil {
+		salt := GenerateSalt()
+		user = User{
+			Name:       UniqueUserName(ToString(claims["name"]), email),
+			Email:      email,
+			Password:   GenerateSecurePassword(RandomString(), salt),
+			Salt:       salt,
+			NoPassword: true,
+		}
+
+		if err = db.Create(&user).Error; err != nil {
+			return user, errors.New("klaida saugojant duomenis. bandykite dar kartą")
+		}
+	} else if user.Temporary {
+		// The provider verified the email, so the guest owns it. Guests
+		// never set a password, it is set later like for new accounts
+		user.Temporary = false
+		user.Salt = GenerateSalt()
+		user.Password = GenerateSecurePassword(RandomString(), user.Salt)
+		user.NoPassword = true
+
+		if err = db.Save(&user).Error; err != nil {
+			return user, errors.New("klaida saugojant duomenis. bandykite dar kartą")
+		}
+	}
+
+	if err = db.Create(&OidcIdentity{Provider: provider, Subject: subject, UserID: user.ID}).Error; err != nil {
+		return user, errors.New("klaida saugojant duomenis. bandykite dar kartą")
+	}
+
+	return user, nil
+}
+
+// UniqueUserName derives a free user name from the provider profile
+func UniqueUserName(name string, email string) string {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		name = strings.Split(email, "@")[0]
+	}
+
+	candidate := name
+	for NameTaken(candidate, &User{}) != nil {
+		candidate = name + "-" + GenerateSalt()[0:4]
+	}
+
+	return candidate
+}
+
+func RandomString() string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	return base64.RawURLEncoding.EncodeToString(random)
+}
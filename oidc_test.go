@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/steinfletcher/apitest"
+)
+
+// fakeIssuer is a minimal OIDC provider that remembers the
+// PKCE challenge and nonce of the last authorization request
+type fakeIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func NewFakeIssuer(t *testing.T) *fakeIssuer {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	issuer := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []JWK{{
+			Kty: "RSA",
+			Kid: "fake",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "fake-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.IDToken(issuer.nonce)})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (f *fakeIssuer) Authorize(authorizationURL string) {
+	parsed, _ := url.Parse(authorizationURL)
+	f.challenge = parsed.Query().Get("code_challenge")
+	f.nonce = parsed.Query().Get("nonce")
+}
+
+func (f *fakeIssuer) IDToken(nonce string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            f.server.URL,
+		"aud":            "test-client",
+		"sub":            "fake-subject",
+		"email":          "oidcUser@email.com",
+		"email_verified": true,
+		"nonce":          nonce,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "fake"
+
+	signed, _ := token.SignedString(f.key)
+	return signed
+}
+
+func SetupFakeProvider(t *testing.T) *fakeIssuer {
+	issuer := NewFakeIssuer(t)
+
+	t.Setenv("OIDC_PROVIDERS", "fake")
+	t.Setenv("OIDC_FAKE_ISSUER", issuer.server.URL)
+	t.Setenv("OIDC_FAKE_CLIENT_ID", "test-client")
+	t.Setenv("OIDC_FAKE_REDIRECT_URL", "http://localhost/oidc/fake/callback")
+
+	delete(oidcProviders, "fake")
+	t.Cleanup(func() {
+		delete(oidcProviders, "fake")
+	})
+
+	return issuer
+}
+
+func TestOidcCodeExchange(t *testing.T) {
+	issuer := SetupFakeProvider(t)
+
+	provider, err := GetOidcProvider("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := RandomString()
+	issuer.Authorize(provider.AuthorizationURL("state", "nonce", verifier))
+
+	if _, err = provider.ExchangeCode("fake-code", "wrong-verifier"); err == nil {
+		t.Error("exchange with wrong PKCE verifier should fail")
+	}
+
+	idToken, err := provider.ExchangeCode("fake-code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = provider.VerifyIDToken(idToken, "other-nonce"); err == nil {
+		t.Error("id_token with wrong nonce should be rejected")
+	}
+
+	claims, err := provider.VerifyIDToken(idToken, "nonce")
+	if err != nil || claims["email"] != "oidcUser@email.com" {
+		t.Errorf("expected valid id_token, got %v %v", claims, err)
+	}
+
+	provider.ClientID = "other-client"
+	if _, err = provider.VerifyIDToken(idToken, "nonce"); err == nil {
+		t.Error("id_token for another audience should be rejected")
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	SetupFakeProvider(t)
+
+	app := NewApp().InitRouter()
+
+	apitest.New("UnknownProvider").
+		Handler(app.Router).
+		Get("/oidc/unknown/login").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	result := apitest.New("RedirectsToProvider").
+		Handler(app.Router).
+		Get("/oidc/fake/login").
+		Expect(t).
+		Status(http.StatusFound).
+		CookiePresent(oidcStateCookie).
+		End()
+
+	location := result.Response.Header.Get("Location")
+	if !strings.Contains(location, "code_challenge_method=S256") || !strings.Contains(location, "nonce=") {
+		t.Errorf("expected PKCE authorization request, got %s", location)
+	}
+}
@@ -13,28 +13,65 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+var orderList = listDefinition{
+	Table: "orders",
+	Sorts: map[string]sortField{
+		"createdAt":  {Column: "created_at", Field: "CreatedAt"},
+		"totalPrice": {Column: "total_price", Field: "TotalPrice"},
+		"status":     {Column: "status", Field: "Status"},
+	},
+	DefaultSort: "-createdAt",
+}
+
+// GetOrders lists the user's orders (every order for admins) page by
+// page. Filters: status (e.g. status=1,2), from and to (creation date)
 func GetOrders(w http.ResponseWriter, r *http.Request) {
 	email := GetClaim("email", r)
 	permissions := strings.ToLower(*GetClaim("permissions", r))
 
-	var orders []Order
+	orders := make([]Order, 0)
+
+	params, err := ParseListParams(r, orderList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	statusFilter, err := StatusFilter(r, "orders.status")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	createdFilter, err := DateRangeFilter(r, "orders.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
 
 	tx := db.Preload(clause.Associations)
 	tx.Preload("ShopOrders", func(db *gorm.DB) *gorm.DB {
 		return db.Order("created_at desc")
 	})
 
-	tx.Preload("ShopOrders.OrderedProducts").Preload("ShopOrders.Collector")
-	tx.Preload("ShopOrders.OrderedProducts.Product", func(db *gorm.DB) *gorm.DB {
+	PreloadOrderedProducts(tx, "ShopOrders.OrderedProducts")
+	tx.Preload("ShopOrders.Collector").Preload("ShopOrders.Shop", func(db *gorm.DB) *gorm.DB {
 		return db.Unscoped()
-	}).Preload("ShopOrders.Shop")
-	// Only filter if user is not an admin
-	if !strings.ContainsAny(permissions, "aA") {
-		tx.Where("email = ?", email)
+	})
+	PreloadHistory(tx, "History")
+	PreloadHistory(tx, "ShopOrders.History")
+
+	filters := func(tx *gorm.DB) *gorm.DB {
+		// Only filter if user is not an admin
+		if !strings.ContainsAny(permissions, "aA") {
+			tx.Where("orders.email = ?", email)
+		}
+
+		return createdFilter(statusFilter(tx))
 	}
 
-	tx.Order("created_at desc").Find(&orders)
-	JSONResponse(orders, w)
+	page, err := Paginate(tx, &Order{}, filters, params, &orders)
+	PageResponse(w, page, err)
 }
 
 func PlaceOrder(w http.ResponseWriter, r *http.Request) {
@@ -70,42 +107,24 @@ func PlaceOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for errors:
-	// does product exist, is the quantity correct
-	var orderedProducts []OrderedProduct
-	errors := make(map[string]string)
-
-	totalPrice := decimal.Zero
-	productCache := make(map[string]Product)
-	shopsWithOrders := make(map[string]bool)
-
-	for _, orderedProduct := range request.OrderedProducts {
-		var product Product
-
-		err := db.Take(&product, "codename = ?", orderedProduct.Product.Codename).Error
-		if err != nil {
-			errors[orderedProduct.Product.Codename] = "produkto nepavyko rasti"
-			continue
-		}
-
-		if orderedProduct.Quantity > product.Quantity {
-			errors[orderedProduct.Product.Codename] = fmt.Sprintf("produktas turi tik %d likusius vientos", product.Quantity)
-			continue
-		}
-
-		newProductOrder := OrderedProduct{
-			ProductID: product.ID,
-			Quantity:  orderedProduct.Quantity,
+	var userErr error
+	order, errors, err := SubmitOrder(request.OrderedProducts, func(plan orderPlan) (Order, error) {
+		if request.User.Temporary {
+			// create temp user
+			if userErr = CreateTempUser(request.User); userErr != nil {
+				return Order{}, userErr
+			}
 		}
 
-		quantityDecimal := decimal.NewFromInt(int64(orderedProduct.Quantity))
-		totalPrice = totalPrice.Add(product.Price.Mul(quantityDecimal))
-
-		orderedProducts = append(orderedProducts, newProductOrder)
-
-		shopsWithOrders[product.ShopID] = true
-		productCache[product.ID] = product
-	}
+		return Order{
+			Email:           request.User.Email,
+			Note:            request.Note,
+			Address:         *request.Address,
+			PaymentType:     *request.PaymentType,
+			TotalPrice:      plan.TotalPrice.Round(2),
+			CancelIfMissing: request.CancelIfMissing,
+		}, nil
+	})
 
 	// Return errors
 	if len(errors) > 0 {
@@ -113,56 +132,14 @@ func PlaceOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.User.Temporary {
-		// create temp user
-		err = CreateTempUser(request.User)
-
-		if err != nil {
-			Response(w, http.StatusBadRequest, err.Error())
-			return
-		}
-	}
-
-	// No errors, create order
-	order := Order{
-		Codename:        GenerateOrderIdentifier(),
-		Email:           request.User.Email,
-		Status:          1,
-		Note:            request.Note,
-		Address:         *request.Address,
-		PaymentType:     *request.PaymentType,
-		TotalPrice:      totalPrice.Round(2),
-		CancelIfMissing: request.CancelIfMissing,
-	}
-
-	db.Create(&order)
-
-	shopOrders := make(map[string]string)
-	// Create ordered products
-	for shopID := range shopsWithOrders {
-		shopOrder := ShopOrder{
-			OrderID: order.ID,
-			ShopID:  shopID,
-		}
-		db.Create(&shopOrder)
-
-		shopOrders[shopID] = shopOrder.ID
+	if userErr != nil {
+		Response(w, http.StatusBadRequest, userErr.Error())
+		return
 	}
 
-	// Create ordered products
-	for _, orderedProduct := range orderedProducts {
-		// Reduce quantity
-		product := productCache[orderedProduct.ProductID]
-		product.Quantity -= orderedProduct.Quantity
-		db.Save(&product)
-
-		//productCopy := CreateProductCopy(product)
-
-		// Set parameters for order
-		orderedProduct.OrderID = order.ID
-		orderedProduct.ProductID = product.ID
-		orderedProduct.ShopOrderID = shopOrders[product.ShopID]
-		db.Create(&orderedProduct)
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida sukuriant užsakymą")
+		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -187,6 +164,16 @@ func CancelOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Once a farmer handed the products over they can't be cancelled
+	var handedOver int64
+	db.Model(&ShopOrder{}).Where("order_id = ? AND status = ?", order.ID, 2).Count(&handedOver)
+	if order.Status >= 4 || handedOver > 0 {
+		Response(w, http.StatusBadRequest, "užsakymo atšaukti nebegalima, jis jau perduotas pristatymui")
+		return
+	}
+
+	before := AuditFields(order)
+
 	order.Status = 5
 	err = db.Save(&order).Error
 	if err != nil {
@@ -194,7 +181,11 @@ func CancelOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	OnOrderChange(order)
+	actorID := RequestActorID(r)
+	RecordOrderStatus(order.ID, order.Status, actorID, "")
+
+	WriteAuditChange(r, "order.cancel", "order", order.ID, before, order)
+	OnOrderChange(order, actorID)
 }
 
 func ChangeOrder(w http.ResponseWriter, r *http.Request) {
@@ -233,6 +224,8 @@ func ChangeOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := AuditFields(order)
+
 	if request.Status != nil {
 		order.Status = *request.Status
 	}
@@ -261,67 +254,373 @@ func ChangeOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	OnOrderChange(order)
-}
-
-func DeleteTempUser(email string) {
-	var user User
-	err := db.Take(&user, "email = ? AND temporary = ?", email, true).Error
-	if err == nil {
-		db.Unscoped().Delete(&user)
+	if order.Status != before["Status"] {
+		RecordOrderStatus(order.ID, order.Status, user.ID, "")
 	}
+
+	WriteAuditChange(r, "order.update", "order", order.ID, before, order)
+	OnOrderChange(order, user.ID)
 }
 
-func OnShopOrderChange(shopOrder ShopOrder) {
+// OnShopOrderChange moves the order along with its shop orders, actorID
+// is recorded as the author of the resulting status changes
+func OnShopOrderChange(shopOrder ShopOrder, actorID string) {
 	if shopOrder.Status == 1 {
 		var shopOrders []ShopOrder
 		if db.Where("status = ? AND order_id = ?", 0, shopOrder.OrderID).Find(&shopOrders).RowsAffected > 0 {
 			return
 		}
 
-		db.Model(&Order{}).Where("id = ?", shopOrder.OrderID).Update("status", 2)
+		UpdateOrderStatus(shopOrder.OrderID, 2, actorID)
 	} else if shopOrder.Status == 2 {
 		var shopOrders []ShopOrder
 		if db.Where("status < ? AND order_id = ?", 2, shopOrder.OrderID).Find(&shopOrders).RowsAffected > 0 {
 			return
 		}
 
-		db.Model(&Order{}).Where("id = ?", shopOrder.OrderID).Update("status", 3)
+		UpdateOrderStatus(shopOrder.OrderID, 3, actorID)
 	} else if shopOrder.Status > 2 {
+		RestockShopOrder(shopOrder.ID, actorID)
+
 		var order Order
 		db.Take(&order, "id = ?", shopOrder.OrderID)
 
 		if order.CancelIfMissing {
 			order.Status = 5
-			OnOrderChange(order)
+			RecordOrderStatus(order.ID, order.Status, actorID, "")
+			OnOrderChange(order, actorID)
 		} else {
-			// Remove cancelled shop order product price from total price
-			var products []map[string]interface{}
-			tx := db.Unscoped().Table("products").Select("products.price", "ordered_products.quantity")
-			tx.Joins("left join ordered_products on ordered_products.product_id = products.id")
-			tx.Where("ordered_products.shop_order_id = ?", shopOrder.ID)
-			tx.Find(&products)
+			// Cancelled shop orders are left out of the total price
+			order.TotalPrice = OrderTotal(order.ID)
+		}
 
-			sum := decimal.Zero
+		db.Save(&order)
+	}
+}
 
-			for _, product := range products {
-				price, _ := decimal.NewFromString(fmt.Sprint(product["price"]))
-				quantity, _ := decimal.NewFromString(fmt.Sprint(product["quantity"]))
+// Guests are kept after delivery, deleting them would let anyone
+// register their email and see the order history without verifying it.
+// They can claim the account through StartAccountClaim instead
+func OnOrderChange(order Order, actorID string) {
+	if order.Status > 4 { // Cancelled or error
+		var shopOrders []ShopOrder
+		db.Select("id").Where("order_id = ? AND status <> ?", order.ID, 3).Find(&shopOrders)
 
-				sum = sum.Add(price.Mul(quantity))
-			}
+		for _, shopOrder := range shopOrders {
+			db.Model(&shopOrder).Update("status", 3)
+			RecordShopOrderStatus(shopOrder.ID, 3, actorID, "")
+			RestockShopOrder(shopOrder.ID, actorID)
+		}
+	}
+}
 
-			order.TotalPrice = order.TotalPrice.Sub(sum)
+// UpdateOrderStatus sets the status unless the order already has it
+func UpdateOrderStatus(orderID string, status int, actorID string) {
+	result := db.Model(&Order{}).Where("id = ? AND status <> ?", orderID, status).Update("status", status)
+	if result.RowsAffected > 0 {
+		RecordOrderStatus(orderID, status, actorID, "")
+	}
+}
+
+func RecordOrderStatus(orderID string, status int, actorID string, message string) {
+	db.Create(&StatusChange{OrderID: &orderID, Status: status, ActorID: NullableID(actorID), Message: message})
+}
+
+func RecordShopOrderStatus(shopOrderID string, status int, actorID string, message string) {
+	db.Create(&StatusChange{ShopOrderID: &shopOrderID, Status: status, ActorID: NullableID(actorID), Message: message})
+}
+
+// PreloadHistory loads a status timeline oldest first, with the actors
+// of each change
+func PreloadHistory(tx *gorm.DB, association string) {
+	tx.Preload(association, func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at")
+	}).Preload(association + ".Actor")
+}
+
+func NullableID(id string) *string {
+	if len(id) == 0 {
+		return nil
+	}
+
+	return &id
+}
+
+var errOrderRejected = fmt.Errorf("order rejected")
+
+// orderPlan holds the checked lines of an order until it is created.
+// Products and Variants hold the stock left after the planned lines
+type orderPlan struct {
+	tx              *gorm.DB
+	OrderedProducts []OrderedProduct
+	TotalPrice      decimal.Decimal
+	Products        map[string]Product
+	Variants        map[string]ProductVariant
+	Shops           map[string]bool
+}
+
+// SubmitOrder plans the order and creates it in one transaction. The
+// ordered products stay locked until it commits, so stock changes made
+// in the meantime wait instead of being overwritten. prepare fills in
+// the order once the plan is known. Returns the plan's errors, keyed by
+// product codename
+func SubmitOrder(requested []OrderedProduct, prepare func(plan orderPlan) (Order, error)) (Order, map[string]string, error) {
+	var order Order
+	var errors map[string]string
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		plan, planErrors := PlanOrder(tx, requested)
+		if len(planErrors) > 0 {
+			errors = planErrors
+			return errOrderRejected
 		}
 
-		db.Save(&order)
+		prepared, err := prepare(plan)
+		if err != nil {
+			return err
+		}
+
+		order, err = CreateOrder(tx, prepared, plan)
+		return err
+	})
+
+	if err == errOrderRejected {
+		err = nil
 	}
+
+	return order, errors, err
 }
 
-func OnOrderChange(order Order) {
-	if order.Status == 4 {
-		DeleteTempUser(order.Email)
-	} else if order.Status > 4 { // Cancelled or error
-		db.Model(&ShopOrder{}).Where("order_id = ?", order.ID).Update("status", 3)
+// PlanOrder checks that the ordered products exist, can be ordered and
+// are in stock. Bundles are expanded into their components. Errors are
+// keyed by product codename
+func PlanOrder(tx *gorm.DB, requested []OrderedProduct) (orderPlan, map[string]string) {
+	plan := orderPlan{
+		tx:         tx,
+		TotalPrice: decimal.Zero,
+		Products:   make(map[string]Product),
+		Variants:   make(map[string]ProductVariant),
+		Shops:      make(map[string]bool),
 	}
+	errors := make(map[string]string)
+
+	for _, orderedProduct := range requested {
+		codename := orderedProduct.Product.Codename
+
+		product, err := plan.TakeProduct("codename = ?", codename)
+		if err != nil {
+			errors[codename] = "produkto nepavyko rasti"
+			continue
+		}
+
+		if message := AvailabilityError(product, time.Now()); len(message) > 0 {
+			errors[codename] = message
+			continue
+		}
+
+		if err = ValidateQuantity(orderedProduct.Quantity, ProductStep(product)); err != nil {
+			errors[codename] = err.Error()
+			continue
+		}
+
+		sku := ""
+		if orderedProduct.Variant != nil {
+			sku = orderedProduct.Variant.SKU
+		}
+
+		line, price, message := plan.Reserve(product, sku, orderedProduct.Quantity)
+		if len(message) == 0 && len(product.BundleItems) > 0 {
+			line.Components, message = plan.ReserveComponents(product, orderedProduct.Quantity)
+		}
+
+		if len(message) > 0 {
+			errors[codename] = message
+			continue
+		}
+
+		// Items priced by weight are re-totalled once the farmer weighs them
+		plan.TotalPrice = plan.TotalPrice.Add(price.Mul(orderedProduct.Quantity))
+
+		plan.OrderedProducts = append(plan.OrderedProducts, line)
+		plan.Shops[product.ShopID] = true
+	}
+
+	return plan, errors
+}
+
+// TakeProduct locks and loads a product with the stock left in the plan.
+// Variants are only changed with their product locked
+func (plan *orderPlan) TakeProduct(query string, args ...interface{}) (Product, error) {
+	var product Product
+	err := plan.tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Variants").Preload("BundleItems").
+		Where(query, args...).Take(&product).Error
+	if err != nil {
+		return product, err
+	}
+
+	if cached, ok := plan.Products[product.ID]; ok {
+		product.Quantity = cached.Quantity
+	}
+
+	return product, nil
+}
+
+// Reserve takes the quantity out of the planned stock of the product or
+// of its variant. Products with variants are ordered by the variant's
+// SKU. Returns the line, its unit price or the reason it can not be ordered
+func (plan *orderPlan) Reserve(product Product, sku string, quantity decimal.Decimal) (OrderedProduct, decimal.Decimal, string) {
+	line := OrderedProduct{ProductID: product.ID, RevisionID: product.RevisionID, Quantity: quantity}
+	price, stock := product.Price, product.Quantity
+
+	if len(product.Variants) > 0 {
+		if len(sku) == 0 {
+			return line, price, "pasirinkite produkto variantą"
+		}
+
+		variant, ok := FindVariant(product, sku)
+		if !ok {
+			return line, price, "produkto varianto nepavyko rasti"
+		}
+
+		if cached, ok := plan.Variants[variant.ID]; ok {
+			variant = cached
+		}
+
+		if quantity.GreaterThan(variant.Quantity) {
+			return line, price, fmt.Sprintf("produktas turi tik %s %s likusius vientos", variant.Quantity.String(), product.Unit)
+		}
+
+		variant.Quantity = variant.Quantity.Sub(quantity)
+		plan.Variants[variant.ID] = variant
+		line.VariantID = &variant.ID
+
+		// The product's quantity is the total of its variants
+		product.Quantity = stock.Sub(quantity)
+		plan.Products[product.ID] = product
+
+		return line, variant.Price, ""
+	}
+
+	// Bundle stock comes from the components
+	if len(product.BundleItems) == 0 {
+		if quantity.GreaterThan(stock) {
+			return line, price, fmt.Sprintf("produktas turi tik %s %s likusius vientos", stock.String(), product.Unit)
+		}
+
+		product.Quantity = stock.Sub(quantity)
+	}
+
+	plan.Products[product.ID] = product
+	return line, price, ""
+}
+
+// ReserveComponents reserves the components of the given number of bundles
+func (plan *orderPlan) ReserveComponents(bundle Product, quantity decimal.Decimal) ([]OrderedProduct, string) {
+	components := make([]OrderedProduct, 0, len(bundle.BundleItems))
+
+	for _, item := range bundle.BundleItems {
+		component, err := plan.TakeProduct("codename = ? AND shop_id = ?", item.ComponentCodename, bundle.ShopID)
+		if err != nil {
+			return nil, fmt.Sprintf("rinkinio produkto %s nepavyko rasti", item.ComponentCodename)
+		}
+
+		line, _, message := plan.Reserve(component, item.VariantSKU, item.Quantity.Mul(quantity))
+		if len(message) > 0 {
+			return nil, fmt.Sprintf("%s: %s", item.ComponentCodename, message)
+		}
+
+		components = append(components, line)
+	}
+
+	return components, ""
+}
+
+// CreateOrder creates the order with a shop order for every shop in the
+// plan and takes the ordered products out of stock, within the plan's
+// transaction
+func CreateOrder(tx *gorm.DB, order Order, plan orderPlan) (Order, error) {
+	order.Codename = GenerateOrderIdentifier()
+	order.Status = 1
+
+	if err := tx.Create(&order).Error; err != nil {
+		return order, err
+	}
+
+	var buyer User
+	tx.Select("id").Take(&buyer, "email = ?", order.Email)
+
+	if err := tx.Create(&StatusChange{OrderID: &order.ID, Status: order.Status, ActorID: NullableID(buyer.ID)}).Error; err != nil {
+		return order, err
+	}
+
+	shopOrders := make(map[string]string)
+	for shopID := range plan.Shops {
+		shopOrder := ShopOrder{
+			OrderID: order.ID,
+			ShopID:  shopID,
+		}
+
+		if err := tx.Create(&shopOrder).Error; err != nil {
+			return order, err
+		}
+
+		if err := tx.Create(&StatusChange{ShopOrderID: &shopOrder.ID, Status: shopOrder.Status, ActorID: NullableID(buyer.ID)}).Error; err != nil {
+			return order, err
+		}
+
+		shopOrders[shopID] = shopOrder.ID
+	}
+
+	// Create ordered products
+	for _, orderedProduct := range plan.OrderedProducts {
+		shopOrderID := shopOrders[plan.Products[orderedProduct.ProductID].ShopID]
+
+		orderedProduct.OrderID = order.ID
+		orderedProduct.ShopOrderID = shopOrderID
+		if err := tx.Omit("Components").Create(&orderedProduct).Error; err != nil {
+			return order, err
+		}
+
+		// Bundles are sold out of their components' stock
+		if len(orderedProduct.Components) == 0 {
+			if err := SellProduct(tx, orderedProduct, plan, buyer.ID); err != nil {
+				return order, err
+			}
+		}
+
+		for _, component := range orderedProduct.Components {
+			component.OrderID = order.ID
+			component.ShopOrderID = shopOrderID
+			component.BundleLineID = &orderedProduct.ID
+			if err := tx.Create(&component).Error; err != nil {
+				return order, err
+			}
+
+			if err := SellProduct(tx, component, plan, buyer.ID); err != nil {
+				return order, err
+			}
+		}
+	}
+
+	return order, nil
+}
+
+// SellProduct takes an ordered product out of stock and records the sale
+func SellProduct(tx *gorm.DB, line OrderedProduct, plan orderPlan, actorID string) error {
+	if line.VariantID != nil {
+		err := tx.Model(&ProductVariant{}).Where("id = ?", *line.VariantID).
+			Update("quantity", gorm.Expr("quantity - ?", line.Quantity)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// The product's quantity is the total of its variants
+	err := tx.Model(&Product{}).Where("id = ?", line.ProductID).
+		Update("quantity", gorm.Expr("quantity - ?", line.Quantity)).Error
+	if err != nil {
+		return err
+	}
+
+	return RecordSale(tx, line, plan, actorID)
 }
@@ -5,11 +5,12 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/shopspring/decimal"
 	"github.com/steinfletcher/apitest"
 )
 
 func PlaceOrderTemp(t *testing.T) {
-	OrderedProducts := []OrderedProduct{{Quantity: 1}}
+	OrderedProducts := []OrderedProduct{{Quantity: decimal.NewFromInt(1)}}
 
 	app := NewApp().InitRouter().InitDB(".env-test")
 
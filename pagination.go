@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+const defaultPageLimit = 20
+const maxPageLimit = 100
+
+// Page is the response of every paginated list endpoint
+type Page struct {
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	Limit      int         `json:"limit"`
+	NextCursor *string     `json:"nextCursor"`
+}
+
+// sortField maps a sort parameter to a column and to the struct field
+// holding its value, which ends up in the cursor
+type sortField struct {
+	Column string
+	Field  string
+}
+
+// listDefinition describes which fields of a table a list endpoint can be sorted by
+type listDefinition struct {
+	Table       string
+	Sorts       map[string]sortField
+	DefaultSort string
+}
+
+type ListParams struct {
+	Table    string
+	Limit    int
+	SortName string
+	Sort     sortField
+	Desc     bool
+	Cursor   *listCursor
+}
+
+// listCursor points right after the last returned row. The ID breaks
+// ties between rows with the same sort value
+type listCursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    string          `json:"id"`
+}
+
+var errBadListParams = errors.New("blogi paieškos parametrai")
+
+// ParseListParams reads limit, sort (field, -field for descending) and cursor
+func ParseListParams(r *http.Request, definition listDefinition) (ListParams, error) {
+	query := r.URL.Query()
+	params := ListParams{Table: definition.Table}
+
+	limit, err := ParseLimit(r)
+	if err != nil {
+		return params, err
+	}
+
+	params.Limit = limit
+
+	sort := query.Get("sort")
+	if len(sort) == 0 {
+		sort = definition.DefaultSort
+	}
+
+	params.SortName = sort
+	params.Desc = strings.HasPrefix(sort, "-")
+
+	field, ok := definition.Sorts[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return params, errBadListParams
+	}
+
+	params.Sort = field
+	params.Sort.Column = definition.Table + "." + field.Column
+
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return params, errBadListParams
+		}
+
+		params.Cursor = &listCursor{}
+		if err = json.Unmarshal(decoded, params.Cursor); err != nil || params.Cursor.Sort != sort {
+			return params, errBadListParams
+		}
+	}
+
+	return params, nil
+}
+
+// Paginate counts the rows matching filters, then loads a single page
+// into items (a pointer to a slice) using query with its preloads
+func Paginate(query *gorm.DB, model interface{}, filters func(*gorm.DB) *gorm.DB, params ListParams, items interface{}) (Page, error) {
+	page := Page{Items: items, Limit: params.Limit}
+
+	if err := db.Model(model).Scopes(filters).Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	tx := query.Scopes(filters)
+
+	direction, operator := "asc", ">"
+	if params.Desc {
+		direction, operator = "desc", "<"
+	}
+
+	idColumn := params.Table + ".id"
+	itemType := reflect.TypeOf(items).Elem().Elem()
+
+	if params.Cursor != nil {
+		field, ok := itemType.FieldByName(params.Sort.Field)
+		if !ok {
+			return page, errBadListParams
+		}
+
+		value := reflect.New(field.Type)
+		if err := json.Unmarshal(params.Cursor.Value, value.Interface()); err != nil {
+			return page, errBadListParams
+		}
+
+		statement := fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND %[3]s %[2]s ?))", params.Sort.Column, operator, idColumn)
+		tx.Where(statement, value.Elem().Interface(), value.Elem().Interface(), params.Cursor.ID)
+	}
+
+	tx.Order(params.Sort.Column + " " + direction).Order(idColumn + " " + direction)
+
+	if err := tx.Limit(params.Limit + 1).Find(items).Error; err != nil {
+		return page, err
+	}
+
+	// One extra row is loaded to know whether there is a next page
+	slice := reflect.ValueOf(items).Elem()
+	if slice.Len() <= params.Limit {
+		return page, nil
+	}
+
+	slice.Set(slice.Slice(0, params.Limit))
+	last := slice.Index(params.Limit - 1)
+
+	value, err := json.Marshal(last.FieldByName(params.Sort.Field).Interface())
+	if err != nil {
+		return page, err
+	}
+
+	cursor, err := json.Marshal(listCursor{Sort: params.SortName, Value: value, ID: last.FieldByName("ID").String()})
+	if err != nil {
+		return page, err
+	}
+
+	nextCursor := base64.RawURLEncoding.EncodeToString(cursor)
+	page.NextCursor = &nextCursor
+
+	return page, nil
+}
+
+// PaginateByOffset loads a page of rows ordered by query. Used where rows
+// have no stable sort key, the cursor holds an offset instead
+func PaginateByOffset(r *http.Request, query *gorm.DB, model interface{}, filters func(*gorm.DB) *gorm.DB, sort string, items interface{}) (Page, error) {
+	limit, err := ParseLimit(r)
+	if err != nil {
+		return Page{}, err
+	}
+
+	offset, err := ParseOffsetCursor(r, sort)
+	if err != nil {
+		return Page{}, err
+	}
+
+	page := Page{Items: items, Limit: limit}
+	if err = db.Model(model).Scopes(filters).Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	if err = query.Scopes(filters).Offset(offset).Limit(limit).Find(items).Error; err != nil {
+		return page, err
+	}
+
+	if int64(offset+limit) < page.Total {
+		nextCursor := OffsetCursor(sort, offset+limit)
+		page.NextCursor = &nextCursor
+	}
+
+	return page, nil
+}
+
+// OffsetCursor is used where rows have no stable sort key, e.g. search relevance
+func OffsetCursor(sort string, offset int) string {
+	cursor, _ := json.Marshal(listCursor{Sort: sort, Value: json.RawMessage(strconv.Itoa(offset))})
+	return base64.RawURLEncoding.EncodeToString(cursor)
+}
+
+func ParseOffsetCursor(r *http.Request, sort string) (int, error) {
+	cursor := r.URL.Query().Get("cursor")
+	if len(cursor) == 0 {
+		return 0, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errBadListParams
+	}
+
+	var parsed listCursor
+	if err = json.Unmarshal(decoded, &parsed); err != nil || parsed.Sort != sort {
+		return 0, errBadListParams
+	}
+
+	offset, err := strconv.Atoi(string(parsed.Value))
+	if err != nil || offset < 0 {
+		return 0, errBadListParams
+	}
+
+	return offset, nil
+}
+
+// ParseLimit reads the limit parameter the same way ParseListParams does
+func ParseLimit(r *http.Request) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if len(limit) == 0 {
+		return defaultPageLimit, nil
+	}
+
+	parsedLimit, err := strconv.Atoi(limit)
+	if err != nil || parsedLimit < 1 {
+		return 0, errBadListParams
+	}
+
+	if parsedLimit > maxPageLimit {
+		parsedLimit = maxPageLimit
+	}
+
+	return parsedLimit, nil
+}
+
+// ============================= Filters =============================
+
+// ParseDecimalParam returns nil when the parameter is missing
+func ParseDecimalParam(r *http.Request, name string) (*decimal.Decimal, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	parsed, err := decimal.NewFromString(value)
+	if err != nil {
+		return nil, errBadListParams
+	}
+
+	return &parsed, nil
+}
+
+// ParseDateParam parses 2006-01-02 dates, nil when the parameter is missing
+func ParseDateParam(r *http.Request, name string) (*time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, errBadListParams
+	}
+
+	return &parsed, nil
+}
+
+// ParseIntSetParam parses comma separated or repeated integers, e.g. status=1,2
+func ParseIntSetParam(r *http.Request, name string) ([]int, error) {
+	var values []int
+
+	for _, param := range r.URL.Query()[name] {
+		for _, value := range strings.Split(param, ",") {
+			parsed, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, errBadListParams
+			}
+
+			values = append(values, parsed)
+		}
+	}
+
+	return values, nil
+}
+
+// DateRangeFilter limits column to the from and to parameters, both inclusive
+func DateRangeFilter(r *http.Request, column string) (func(*gorm.DB) *gorm.DB, error) {
+	from, err := ParseDateParam(r, "from")
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := ParseDateParam(r, "to")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(tx *gorm.DB) *gorm.DB {
+		if from != nil {
+			tx.Where(column+" >= ?", *from)
+		}
+
+		if to != nil {
+			tx.Where(column+" < ?", to.AddDate(0, 0, 1))
+		}
+
+		return tx
+	}, nil
+}
+
+// StatusFilter limits column to the statuses listed in the status parameter
+func StatusFilter(r *http.Request, column string) (func(*gorm.DB) *gorm.DB, error) {
+	statuses, err := ParseIntSetParam(r, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(tx *gorm.DB) *gorm.DB {
+		if len(statuses) > 0 {
+			tx.Where(column+" IN ?", statuses)
+		}
+
+		return tx
+	}, nil
+}
+
+// PageResponse writes the page, or 400 for bad list parameters
+func PageResponse(w http.ResponseWriter, page Page, err error) {
+	if errors.Is(err, errBadListParams) {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida. bandykite dar kartą")
+		return
+	}
+
+	JSONResponse(page, w)
+}
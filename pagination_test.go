@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseListParams(t *testing.T) {
+	cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"price","v":"2.5","id":"x"}`))
+
+	cases := []struct {
+		name   string
+		query  string
+		limit  int
+		column string
+		desc   bool
+		err    bool
+	}{
+		{name: "Defaults", query: "", limit: defaultPageLimit, column: "products.created_at", desc: true},
+		{name: "SortAscending", query: "sort=price&limit=5", limit: 5, column: "products.price"},
+		{name: "LimitIsCapped", query: "limit=1000", limit: maxPageLimit, column: "products.created_at", desc: true},
+		{name: "UnknownSort", query: "sort=password", err: true},
+		{name: "BadLimit", query: "limit=-1", err: true},
+		{name: "CursorFromOtherSort", query: "sort=-price&cursor=" + cursor, err: true},
+		{name: "Cursor", query: "sort=price&cursor=" + cursor, limit: defaultPageLimit, column: "products.price"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params, err := ParseListParams(httptest.NewRequest("GET", "/products?"+c.query, nil), productList)
+
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if params.Limit != c.limit || params.Sort.Column != c.column || params.Desc != c.desc {
+				t.Errorf("unexpected params %+v", params)
+			}
+		})
+	}
+}
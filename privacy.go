@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DataExport struct {
+	Profile       Profile        `json:"profile"`
+	Orders        []Order        `json:"orders"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	Shop          *Shop          `json:"shop"`
+	Products      []Product      `json:"products"`
+	Sessions      []SessionEntry `json:"sessions"`
+}
+
+type SessionEntry struct {
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+}
+
+// =========================== Handlers ===================================
+
+// ExportMyData returns everything stored about the user as a ZIP
+// archive, or as a single JSON document with ?format=json
+func ExportMyData(w http.ResponseWriter, r *http.Request) {
+	var user User
+	email := GetClaim("email", r)
+	if err := db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	export := CollectUserData(user)
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Disposition", `attachment; filename="data.json"`)
+		JSONResponse(export, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="data.zip"`)
+
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	files := map[string]interface{}{
+		"profile.json":       export.Profile,
+		"orders.json":        export.Orders,
+		"subscriptions.json": export.Subscriptions,
+		"shop.json":          export.Shop,
+		"products.json":      export.Products,
+		"sessions.json":      export.Sessions,
+	}
+
+	for name, content := range files {
+		file, err := archive.Create(name)
+		if err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(content)
+	}
+}
+
+// RequestAccountDeletion schedules the account for deletion after a
+// grace period during which it can be cancelled
+func RequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Password   string `json:"password"`
+		ReauthCode string `json:"reauthCode"`
+	}{"", ""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var user User
+	email := GetClaim("email", r)
+	if err = db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !Reauthenticated(user, request.Password, request.ReauthCode) {
+		Response(w, http.StatusForbidden, "neteisingas dabartinis slaptažodis")
+		return
+	}
+
+	if err = CanDeleteAccount(user); err != nil {
+		Response(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	scheduledAt := time.Now().Add(DeletionGracePeriod())
+	user.DeletionScheduledAt = &scheduledAt
+
+	if err = db.Model(&user).Update("deletion_scheduled_at", scheduledAt).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	WriteAudit(r, "user.deletion_requested", "user", user.ID)
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(NewProfile(user), w)
+}
+
+func CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	var user User
+	email := GetClaim("email", r)
+	if err := db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if user.DeletionScheduledAt == nil {
+		Response(w, http.StatusBadRequest, "paskyros ištrynimas nebuvo užsakytas")
+		return
+	}
+
+	user.DeletionScheduledAt = nil
+	db.Model(&user).Update("deletion_scheduled_at", nil)
+
+	WriteAudit(r, "user.deletion_cancelled", "user", user.ID)
+
+	JSONResponse(NewProfile(user), w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func CollectUserData(user User) DataExport {
+	export := DataExport{
+		Profile:       NewProfile(user),
+		Orders:        make([]Order, 0),
+		Subscriptions: make([]Subscription, 0),
+		Products:      make([]Product, 0),
+		Sessions:      make([]SessionEntry, 0),
+	}
+
+	tx := db.Preload("ShopOrders").Preload("ShopOrders.Shop", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped()
+	})
+	PreloadOrderedProducts(tx, "ShopOrders.OrderedProducts")
+	tx.Where("email = ?", user.Email).Order("created_at desc").Find(&export.Orders)
+
+	db.Preload("Plan.Items").Preload("Cycles").Where("user_id = ?", user.ID).Order("created_at desc").Find(&export.Subscriptions)
+
+	var shop Shop
+	if db.Preload("Locations").Take(&shop, "user_id = ?", user.ID).Error == nil {
+		export.Shop = &shop
+		db.Preload(clause.Associations).Where("shop_id = ?", shop.ID).Find(&export.Products)
+	}
+
+	var refreshTokens []RefreshToken
+	db.Unscoped().Where("email = ?", user.Email).Order("created_at desc").Find(&refreshTokens)
+
+	for _, refreshToken := range refreshTokens {
+		entry := SessionEntry{CreatedAt: refreshToken.CreatedAt}
+		if refreshToken.DeletedAt.Valid {
+			entry.RevokedAt = &refreshToken.DeletedAt.Time
+		}
+
+		export.Sessions = append(export.Sessions, entry)
+	}
+
+	return export
+}
+
+func DeletionGracePeriod() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		days = 14
+	}
+
+	return time.Hour * 24 * time.Duration(days)
+}
+
+// CanDeleteAccount refuses deletion while the user's shop still has
+// orders to fulfil, buyers would lose track of them
+func CanDeleteAccount(user User) error {
+	var shop Shop
+	if db.Select("id").Take(&shop, "user_id = ?", user.ID).Error != nil {
+		return nil
+	}
+
+	err := db.Joins("left join orders on orders.id = shop_orders.order_id").
+		Where("shop_orders.shop_id = ? AND shop_orders.status < ? AND orders.status < ?", shop.ID, 2, 4).
+		Take(&ShopOrder{}).Error
+	if err == nil {
+		return errors.New("parduotuvė turi neįvykdytų užsakymų")
+	}
+
+	return nil
+}
+
+// DeleteAccount removes personal data. Orders are kept for the shops'
+// history, but no longer point to the user. The shop is closed and its
+// products are removed like a manual product deletion would
+func DeleteAccount(user User) error {
+	anonymousEmail := fmt.Sprintf("deleted-%s@anonymized.invalid", user.ID[0:8])
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		orderUpdate := map[string]interface{}{"email": anonymousEmail, "address": "", "note": ""}
+		if err := tx.Model(&Order{}).Where("email = ?", user.Email).Updates(orderUpdate).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Where("email = ?", user.Email).Delete(&RefreshToken{}).Error; err != nil {
+			return err
+		}
+
+		tx.Where("email = ?", user.Email).Delete(&VerificationToken{})
+		tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{})
+		tx.Where("user_id = ?", user.ID).Delete(&OidcIdentity{})
+
+		subscriptions := tx.Model(&Subscription{}).Select("id").Where("user_id = ?", user.ID)
+		tx.Where("subscription_id IN (?)", subscriptions).Delete(&SubscriptionCycle{})
+		tx.Where("user_id = ?", user.ID).Delete(&Subscription{})
+
+		var shop Shop
+		if tx.Take(&shop, "user_id = ?", user.ID).Error == nil {
+			var products []Product
+			tx.Where("shop_id = ?", shop.ID).Find(&products)
+
+			for _, product := range products {
+				if err := RemoveProduct(tx, product); err != nil {
+					return err
+				}
+			}
+
+			tx.Where("shop_id = ?", shop.ID).Delete(&Location{})
+			tx.Where("shop_id = ?", shop.ID).Delete(&ApiKey{})
+			tx.Model(&SubscriptionPlan{}).Where("shop_id = ?", shop.ID).Update("active", false)
+
+			if err := tx.Delete(&shop).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Unscoped().Delete(&user).Error
+	})
+}
+
+// ProcessAccountDeletions deletes accounts whose grace period is over
+func ProcessAccountDeletions() {
+	var users []User
+	db.Where("deletion_scheduled_at < ?", time.Now()).Find(&users)
+
+	for _, user := range users {
+		// Try again later, the shop got new orders during the grace period
+		if CanDeleteAccount(user) != nil {
+			continue
+		}
+
+		if err := DeleteAccount(user); err == nil {
+			db.Create(&AuditEvent{ActorID: user.ID, Action: "user.deleted", EntityType: "user", EntityID: user.ID})
+		}
+	}
+}
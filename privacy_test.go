@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+)
+
+func TestExportMyData(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	_, buyerToken, _ := InitAccount(app, "buyer")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	apitest.New("UnauthorizedNoToken").
+		Handler(app.Router).
+		Get("/me/export").
+		Expect(t).
+		Status(http.StatusUnauthorized).
+		End()
+
+	apitest.New("ExportZip").
+		Handler(app.Router).
+		Get("/me/export").
+		Cookie("Access-Token", buyerToken).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("Content-Type", "application/zip").
+		End()
+
+	apitest.New("ExportJSON").
+		Handler(app.Router).
+		Get("/me/export").
+		Query("format", "json").
+		Cookie("Access-Token", buyerToken).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Chain().Equal("profile.name", "buyer").Present("orders").End()).
+		End()
+}
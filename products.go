@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
@@ -12,88 +13,140 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-func ProductIsOrdered(productID string) bool {
-	err := db.Where("product_id = ?", productID).Take(&OrderedProduct{}).Error
+func ProductIsOrdered(tx *gorm.DB, productID string) bool {
+	err := tx.Where("product_id = ?", productID).Take(&OrderedProduct{}).Error
 	return err == nil
 }
 
-func CreateProductCopy(product Product) Product {
-	var productCopy Product
-	if err := db.Where(Product{BaseProductID: &product.ID}).Take(&productCopy).Error; err != nil {
-		productCopy = product
-
-		productCopy.BaseProductID = new(string)
-		*productCopy.BaseProductID = product.ID
-		productCopy.ID = ""
-		productCopy.Public = false
-		db.Create(&productCopy)
-	}
-
-	return productCopy
-}
-
 func GetPublicOrOwnerProducts(tx *gorm.DB, r *http.Request) {
 	email := GetClaim("email", r)
 
-	statement := "public = ?"
-	shopID := ""
 	if email != nil {
 		var shop Shop
 
 		err := GetShopByEmail(*email, &shop, false, "id")
 		if err == nil {
-			statement += " OR shop_id = ?"
-			shopID = shop.ID
+			tx.Where("("+productVisibleSQL+") OR products.shop_id = ?", shop.ID)
+			return
 		}
 	}
 
-	tx.Where("base_product_id is null").Where(statement, true, shopID)
+	tx.Where(productVisibleSQL)
+}
+
+var productList = listDefinition{
+	Table: "products",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+		"price":     {Column: "price", Field: "Price"},
+		"name":      {Column: "name", Field: "Name"},
+	},
+	DefaultSort: "-createdAt",
 }
 
+// GetProducts lists products page by page. Filters: q (full text search),
+// category and shop codenames, minPrice, maxPrice, from and to (creation
+// date), near, radius and type (see ParseGeoFilter). Without sort search
+// results come by relevance and nearby products by distance
 func GetProducts(w http.ResponseWriter, r *http.Request) {
 	products := make([]Product, 0)
 
-	tx := db.Preload(clause.Associations)
-	GetPublicOrOwnerProducts(tx, r)
+	minPrice, err := ParseDecimalParam(r, "minPrice")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	maxPrice, err := ParseDecimalParam(r, "maxPrice")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	createdFilter, err := DateRangeFilter(r, "products.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	geo, err := ParseGeoFilter(r)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
 
 	r.ParseForm()
 	requestedCategories := r.Form["category"]
+	requestedShops := r.Form["shop"]
+	terms := SearchTerms(r.Form.Get("q"))
 
-	if len(requestedCategories) > 0 {
-		var categoryIDs []string
-		db.Model(&Category{}).Select("id").Where("codename IN ?", requestedCategories).Find(&categoryIDs)
-		if len(categoryIDs) == 0 {
-			JSONResponse(products, w)
-			return
+	filters := func(tx *gorm.DB) *gorm.DB {
+		GetPublicOrOwnerProducts(tx, r)
+
+		if geo != nil {
+			geo.JoinNearby(tx, "products.shop_id")
 		}
 
-		var productIDs []string
-		db.Table("product_categories").Select("product_id").Where("category_id IN ?", categoryIDs).Find(&productIDs)
+		if len(terms) > 0 {
+			tx.Where("products.search_vector @@ to_tsquery('simple', ?)", SearchTSQuery(terms))
+		}
 
-		if len(productIDs) == 0 {
-			JSONResponse(products, w)
-			return
+		if len(requestedCategories) > 0 {
+			tx.Where("products.id IN (?)", db.Table("product_categories").Select("product_id").
+				Joins("join categories on categories.id = product_categories.category_id").
+				Where("categories.codename IN ?", requestedCategories))
+		}
+
+		if len(requestedShops) > 0 {
+			tx.Where("products.shop_id IN (?)", db.Model(&Shop{}).Select("id").Where("codename IN ?", requestedShops))
+		}
+
+		if minPrice != nil {
+			tx.Where("products.price >= ?", *minPrice)
 		}
 
-		tx.Where("id in ?", productIDs)
+		if maxPrice != nil {
+			tx.Where("products.price <= ?", *maxPrice)
+		}
+
+		return createdFilter(tx)
 	}
 
-	requestedShops := r.Form["shop"]
+	query := db.Preload(clause.Associations)
+	if geo != nil {
+		query.Select("products.*, nearby.distance")
+	}
+
+	var page Page
 
-	if len(requestedShops) > 0 {
-		var shopIDs []string
-		db.Model(&Shop{}).Select("id").Where("codename IN ?", requestedShops).Find(&shopIDs)
+	if len(terms) > 0 && len(r.Form.Get("sort")) == 0 {
+		query.Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "? DESC, products.id",
+			Vars:               []interface{}{SearchRank(terms)},
+			WithoutParentheses: true,
+		}})
 
-		if len(shopIDs) == 0 {
-			JSONResponse(products, w)
+		page, err = PaginateByOffset(r, query, &Product{}, filters, "relevance", &products)
+	} else if geo != nil && geo.Near && len(r.Form.Get("sort")) == 0 {
+		query.Order("nearby.distance, products.id")
+		page, err = PaginateByOffset(r, query, &Product{}, filters, "distance", &products)
+	} else {
+		params, paramsErr := ParseListParams(r, productList)
+		if paramsErr != nil {
+			PageResponse(w, Page{}, paramsErr)
 			return
 		}
 
-		tx.Where("shop_id in ?", shopIDs)
+		page, err = Paginate(query, &Product{}, filters, params, &products)
+	}
+
+	ApplyBundleStock(products)
+
+	if err == nil && len(terms) > 0 {
+		page.Items = NewProductSearchResults(products, terms)
 	}
 
-	tx.Order("created_at desc").Find(&products)
-	JSONResponse(products, w)
+	PageResponse(w, page, err)
 }
 
 func GetProduct(w http.ResponseWriter, r *http.Request) {
@@ -102,7 +155,9 @@ func GetProduct(w http.ResponseWriter, r *http.Request) {
 
 	var product Product
 
-	tx := db.Preload(clause.Associations)
+	tx := db.Preload(clause.Associations).Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("price")
+	})
 	GetPublicOrOwnerProducts(tx, r)
 
 	err := tx.Where("codename = ?", productName).Take(&product).Error
@@ -111,6 +166,10 @@ func GetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(product.BundleItems) > 0 {
+		product.Quantity = BundleStock(product)
+	}
+
 	JSONResponse(product, w)
 }
 
@@ -139,16 +198,29 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.ParseMultipartForm(10 << 20)
-	image := FileUpload(r, "file", "product-*.png")
+	image, uploadErr := FileUpload(r, "file", "product")
+	if uploadErr != nil {
+		Response(w, http.StatusBadRequest, uploadErr.Error())
+		return
+	}
 
 	request := struct {
-		Name        *string   `json:"name"`
-		Description *string   `json:"description"`
-		Categories  *[]string `json:"categories"`
-		Price       *float64  `json:"amount"`
-		Public      *bool     `json:"public"`
-		Quantity    *int      `json:"quantity"`
-	}{nil, nil, nil, nil, nil, nil}
+		Name           *string   `json:"name"`
+		SKU            *string   `json:"sku"`
+		Description    *string   `json:"description"`
+		Categories     *[]string `json:"categories"`
+		Price          *float64  `json:"amount"`
+		Public         *bool     `json:"public"`
+		Quantity       *float64  `json:"quantity"`
+		Unit           *string   `json:"unit"`
+		Step           *float64  `json:"step"`
+		PricedByWeight *bool     `json:"pricedByWeight"`
+		PublishAt      *string   `json:"publishAt"`
+		UnpublishAt    *string   `json:"unpublishAt"`
+		AvailableFrom  *string   `json:"availableFrom"`
+		AvailableUntil *string   `json:"availableUntil"`
+		StockThreshold *float64  `json:"lowStockThreshold"`
+	}{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil}
 
 	decoder := schema.NewDecoder()
 	decoder.IgnoreUnknownKeys(true)
@@ -164,10 +236,12 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var productCopy Product
+	var before map[string]interface{}
+	var previous Product
 	if isEdit {
-		db.Preload("Categories").Take(&product, "codename = ?", productName)
-		productCopy = product
+		db.Preload("Categories").Preload("Variants").Preload("BundleItems").Take(&product, "codename = ?", productName)
+		before = AuditFields(product)
+		previous = product
 	}
 
 	// Name
@@ -176,24 +250,119 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The codename stays the same on renames, links to the product keep working
 	if request.Name != nil {
 		product.Name = request.Name
+	}
+
+	if !isEdit {
 		product.Codename = GenerateCodename(*request.Name, true)
 	}
 
+	// SKU, the shop's own product code used by imports
+	if request.SKU != nil {
+		if err = CheckProductSKU(product.ShopID, product.ID, *request.SKU); len(*request.SKU) > 0 && err != nil {
+			Response(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		product.SKU = *request.SKU
+	}
+
+	// Variants, the product's price and quantity are derived from them
+	hasVariants := len(r.FormValue("variants")) > 0
+
+	if hasVariants {
+		variants, variantErr := ParseVariants(r, product.Variants)
+		if variantErr != nil {
+			Response(w, http.StatusBadRequest, variantErr.Error())
+			return
+		}
+
+		if variantErr = CheckVariantSKUs(product.ShopID, product.ID, variants); variantErr != nil {
+			Response(w, http.StatusConflict, variantErr.Error())
+			return
+		}
+
+		product.Variants = variants
+	} else {
+		product.Variants = CopyVariants(product.Variants)
+	}
+
+	// Bundle components, the bundle's stock is derived from them
+	if len(r.FormValue("bundle")) > 0 {
+		items, bundleErr := ParseBundleItems(r)
+		if bundleErr == nil {
+			bundleErr = CheckBundleItems(product.ShopID, product.Codename, items)
+		}
+
+		if bundleErr != nil {
+			Response(w, http.StatusBadRequest, bundleErr.Error())
+			return
+		}
+
+		product.BundleItems = items
+	} else {
+		product.BundleItems = CopyBundleItems(product.BundleItems)
+	}
+
+	isBundle := len(product.BundleItems) > 0
+
+	if isBundle && len(product.Variants) > 0 {
+		Response(w, http.StatusBadRequest, "rinkinys negali turėti variantų")
+		return
+	}
+
 	// Quantity
 	if request.Quantity != nil && *request.Quantity < 0 {
 		Response(w, http.StatusBadRequest, "kiekis turi būti didesnis už 0")
 		return
 	}
 
-	if !isEdit && request.Quantity == nil {
+	if !isEdit && request.Quantity == nil && !hasVariants && !isBundle {
 		Response(w, http.StatusBadRequest, "kiekis yra privalomas")
 		return
 	}
 
 	if request.Quantity != nil {
-		product.Quantity = *request.Quantity
+		product.Quantity = decimal.NewFromFloat(*request.Quantity)
+	}
+
+	// Unit of measure
+	if request.Unit != nil && !productUnits[*request.Unit] {
+		Response(w, http.StatusBadRequest, "netinkamas matavimo vienetas")
+		return
+	}
+
+	if request.Unit != nil {
+		product.Unit = *request.Unit
+	} else if !isEdit {
+		product.Unit = "vnt"
+	}
+
+	if request.Step != nil && *request.Step <= 0 {
+		Response(w, http.StatusBadRequest, "kiekio žingsnis turi būti didesnis už 0")
+		return
+	}
+
+	if request.Step != nil {
+		product.Step = decimal.NewFromFloat(*request.Step)
+	} else if !isEdit {
+		product.Step = decimal.NewFromInt(1)
+	}
+
+	if request.PricedByWeight != nil {
+		product.PricedByWeight = *request.PricedByWeight
+	}
+
+	// Low stock alerts, zero turns them off
+	if request.StockThreshold != nil && *request.StockThreshold < 0 {
+		Response(w, http.StatusBadRequest, "likučio riba negali būti neigiama")
+		return
+	}
+
+	if request.StockThreshold != nil {
+		product.StockThreshold = decimal.NewFromFloat(*request.StockThreshold)
 	}
 
 	// Amount
@@ -202,7 +371,7 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !isEdit && request.Price == nil {
+	if !isEdit && request.Price == nil && !hasVariants {
 		Response(w, http.StatusBadRequest, "kaina yra privaloma")
 		return
 	}
@@ -211,6 +380,12 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		product.Price = decimal.NewFromFloat(*request.Price)
 	}
 
+	ApplyVariantTotals(&product)
+
+	if isBundle {
+		product.Quantity = decimal.Zero
+	}
+
 	// Description
 	if request.Description != nil {
 		product.Description = request.Description
@@ -221,12 +396,35 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		product.Public = *request.Public
 	}
 
-	// Categories
-	if request.Categories != nil {
-		if isEdit {
-			db.Exec("DELETE FROM product_categories WHERE product_id = ?", product.ID)
+	// Scheduled publishing and the season the product can be ordered in
+	schedule := []struct {
+		value *string
+		field **time.Time
+	}{
+		{request.PublishAt, &product.PublishAt},
+		{request.UnpublishAt, &product.UnpublishAt},
+		{request.AvailableFrom, &product.AvailableFrom},
+		{request.AvailableUntil, &product.AvailableUntil},
+	}
+
+	for _, s := range schedule {
+		if s.value == nil {
+			continue
+		}
+
+		if *s.field, err = ParseScheduleTime(*s.value); err != nil {
+			Response(w, http.StatusBadRequest, err.Error())
+			return
 		}
+	}
+
+	if err = ValidateSchedule(product); err != nil {
+		Response(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
+	// Categories
+	if request.Categories != nil {
 		var categories []Category
 		db.Find(&categories, "id in ?", *request.Categories)
 		product.Categories = categories
@@ -241,23 +439,77 @@ func AddEditProduct(w http.ResponseWriter, r *http.Request) {
 		product.Description = new(string)
 	}
 
-	if isEdit {
-		OnProductChange(productCopy)
-	}
+	actorID := RequestActorID(r)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if isEdit {
+			// Orders and stock updates may have changed the stock since the
+			// product was loaded, the request is applied to the locked row
+			var locked Product
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Variants").Take(&locked, "id = ?", product.ID).Error; err != nil {
+				return err
+			}
+
+			previous.Quantity, previous.Variants = locked.Quantity, locked.Variants
+
+			if !hasVariants {
+				product.Variants = CopyVariants(locked.Variants)
+				if request.Quantity == nil {
+					product.Quantity = locked.Quantity
+				}
+
+				ApplyVariantTotals(&product)
+			}
+
+			if isBundle {
+				product.Quantity = decimal.Zero
+			}
+
+			// Replaced variants stay for the orders pointing to them
+			if err := tx.Where("product_id = ?", product.ID).Delete(&ProductVariant{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("bundle_id = ?", product.ID).Delete(&BundleItem{}).Error; err != nil {
+				return err
+			}
+
+			if request.Categories != nil {
+				if err := tx.Exec("DELETE FROM product_categories WHERE product_id = ?", product.ID).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Save(&product).Error; err != nil {
+			return err
+		}
+
+		if err := RecordStockChanges(tx, previous, product, movementAdjustment, actorID); err != nil {
+			return err
+		}
 
-	product.ID = ""
+		return CreateRevision(tx, &product)
+	})
 
-	if err = db.Create(&product).Error; err != nil {
+	if err != nil {
 		Response(w, http.StatusInternalServerError, "įvyko klaida bandant išsaugoti produktą")
 		return
 	}
 
+	RefreshProductSearch("id = ?", product.ID)
+
 	if isEdit {
-		db.Table("product_categories").Where("product_id = ?", productCopy.ID).Update("product_id", product.ID)
+		WriteAuditChange(r, "product.update", "product", product.ID, before, product)
 	} else {
+		WriteAuditChange(r, "product.create", "product", product.ID, nil, product)
 		w.WriteHeader(http.StatusCreated)
 	}
 
+	if isBundle {
+		product.Quantity = BundleStock(product)
+	}
+
 	JSONResponse(product, w)
 }
 
@@ -273,17 +525,14 @@ func DeleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	OnProductChange(product)
-}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return RemoveProduct(tx, product)
+	})
 
-func OnProductChange(product Product) {
-	if ProductIsOrdered(product.ID) {
-		product.BaseProductID = new(string)
-		*product.BaseProductID = product.ID
-		product.Public = false
-		db.Save(&product)
-		db.Delete(&product)
-	} else {
-		db.Unscoped().Delete(&product)
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida trintant produktą")
+		return
 	}
+
+	WriteAuditChange(r, "product.delete", "product", product.ID, product, nil)
 }
@@ -29,7 +29,7 @@ func CreateTempProduct(name string, shop_codename string) Product {
 		Name:     &name,
 		Codename: name,
 		Price:    decimal.NewFromInt(10000),
-		Quantity: 10000,
+		Quantity: decimal.NewFromInt(10000),
 		ShopID:   shop.ID,
 		Public:   true,
 	}
@@ -58,7 +58,7 @@ func TestGetProduct(t *testing.T) {
 		{
 			name:     "GetCorrect",
 			body:     map[string]interface{}{"codename": tempProduct.Codename},
-			response: jsonpath.Chain().Equal("name", *tempProduct.Name).Equal("price", ToString(tempProduct.Price)).Equal("quantity", float64(tempProduct.Quantity)),
+			response: jsonpath.Chain().Equal("name", *tempProduct.Name).Equal("price", ToString(tempProduct.Price)).Equal("quantity", ToString(tempProduct.Quantity)),
 			expected: http.StatusOK,
 		},
 		{
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitStore counts hits per key in fixed windows. The in-memory
+// store is enough for a single instance, multiple instances have to
+// share counters through Postgres (RATE_LIMIT_STORE=postgres)
+type RateLimitStore interface {
+	Hit(key string, window time.Duration) (count int, resetAt time.Time, err error)
+	Reset(key string) error
+}
+
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+var loginIPLimit = rateLimit{Limit: 20, Window: time.Minute * 15}
+var loginAccountLimit = rateLimit{Limit: 10, Window: time.Minute * 15}
+var checkEmailIPLimit = rateLimit{Limit: 10, Window: time.Minute * 15}
+
+// Failed logins before the account gets locked. Every following
+// lockout doubles, up to maxLockout
+const lockoutThreshold = 5
+const baseLockout = time.Minute
+const maxLockout = time.Hour * 24
+
+var rateLimitStore RateLimitStore
+
+// =========================== Handlers ===================================
+
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	user, err := FindUserByParam(r)
+	if err != nil {
+		Response(w, http.StatusNotFound, "vartotojas nerastas")
+		return
+	}
+
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	if err = db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	rateLimitStore.Reset("login:account:" + user.Name)
+	WriteAudit(r, "user.unlock", "user", user.ID)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func InitRateLimitStore() {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		rateLimitStore = &postgresRateLimitStore{}
+		return
+	}
+
+	rateLimitStore = newMemoryRateLimitStore()
+}
+
+// RateLimited registers a hit and responds with 429 when the limit is
+// exceeded. Store errors let the request through
+func RateLimited(w http.ResponseWriter, key string, limit rateLimit) bool {
+	count, resetAt, err := rateLimitStore.Hit(key, limit.Window)
+	if err != nil || count <= limit.Limit {
+		return false
+	}
+
+	TooManyRequests(w, resetAt, "per daug bandymų. bandykite vėliau")
+	return true
+}
+
+func TooManyRequests(w http.ResponseWriter, until time.Time, message string) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	Response(w, http.StatusTooManyRequests, message)
+}
+
+// LockoutDuration returns how long an account is locked after the
+// given number of consecutive failed logins, zero if it is not locked
+func LockoutDuration(failedLogins int) time.Duration {
+	if failedLogins < lockoutThreshold || failedLogins%lockoutThreshold != 0 {
+		return 0
+	}
+
+	lockouts := failedLogins/lockoutThreshold - 1
+	if lockouts > 16 {
+		return maxLockout
+	}
+
+	duration := baseLockout * time.Duration(1<<uint(lockouts))
+	if duration > maxLockout {
+		return maxLockout
+	}
+
+	return duration
+}
+
+// RegisterFailedLogin increases the failed login counter and locks
+// the account when a threshold is reached
+func RegisterFailedLogin(r *http.Request, user User) {
+	user.FailedLogins++
+	WriteAuditAs(r, user.ID, "user.login_failed", "user", user.ID)
+
+	if duration := LockoutDuration(user.FailedLogins); duration > 0 {
+		lockedUntil := time.Now().Add(duration)
+		user.LockedUntil = &lockedUntil
+
+		WriteAuditAs(r, user.ID, "user.lockout", "user", user.ID)
+	}
+
+	db.Model(&user).Select("failed_logins", "locked_until").Updates(&user)
+}
+
+func RegisterSuccessfulLogin(r *http.Request, user User) {
+	WriteAuditAs(r, user.ID, "user.login", "user", user.ID)
+
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+
+	db.Model(&user).Updates(map[string]interface{}{"failed_logins": 0, "locked_until": nil})
+}
+
+func IsLocked(user User) bool {
+	return user.LockedUntil != nil && user.LockedUntil.After(time.Now())
+}
+
+// ============================= Stores =============================
+
+type memoryRateLimitEntry struct {
+	count   int
+	resetAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryRateLimitEntry
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{entries: make(map[string]*memoryRateLimitEntry)}
+}
+
+func (s *memoryRateLimitStore) Hit(key string, window time.Duration) (int, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	// Drop expired entries so the map does not grow forever
+	for k, entry := range s.entries {
+		if entry.resetAt.Before(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &memoryRateLimitEntry{resetAt: now.Add(window)}
+		s.entries[key] = entry
+	}
+
+	entry.count++
+	return entry.count, entry.resetAt, nil
+}
+
+func (s *memoryRateLimitStore) Reset(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+type postgresRateLimitStore struct{}
+
+func (s *postgresRateLimitStore) Hit(key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now()
+
+	var counter RateLimitCounter
+	err := db.Raw(`INSERT INTO rate_limit_counters (key, count, reset_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limit_counters.reset_at < ? THEN 1 ELSE rate_limit_counters.count + 1 END,
+			reset_at = CASE WHEN rate_limit_counters.reset_at < ? THEN EXCLUDED.reset_at ELSE rate_limit_counters.reset_at END
+		RETURNING key, count, reset_at`, key, now.Add(window), now, now).Scan(&counter).Error
+
+	return counter.Count, counter.ResetAt, err
+}
+
+func (s *postgresRateLimitStore) Reset(key string) error {
+	return db.Delete(&RateLimitCounter{}, "key = ?", key).Error
+}
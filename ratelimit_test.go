@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:   0,
+		4:   0,
+		5:   time.Minute,
+		6:   0,
+		10:  time.Minute * 2,
+		15:  time.Minute * 4,
+		500: maxLockout,
+	}
+
+	for failedLogins, expected := range cases {
+		if duration := LockoutDuration(failedLogins); duration != expected {
+			t.Errorf("after %d failed logins expected %v, got %v", failedLogins, expected, duration)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := newMemoryRateLimitStore()
+
+	for i := 1; i <= 3; i++ {
+		count, _, _ := store.Hit("login:ip:127.0.0.1", time.Minute)
+		if count != i {
+			t.Errorf("expected count %d, got %d", i, count)
+		}
+	}
+
+	store.Reset("login:ip:127.0.0.1")
+
+	if count, _, _ := store.Hit("login:ip:127.0.0.1", time.Minute); count != 1 {
+		t.Errorf("expected counter to reset, got %d", count)
+	}
+
+	store.Hit("expired", -time.Second)
+	if count, _, _ := store.Hit("expired", time.Minute); count != 1 {
+		t.Errorf("expected expired window to restart, got %d", count)
+	}
+}
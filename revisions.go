@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// Products used to be recreated on every edit, usually with a new
+// codename. The old row was soft deleted with base_product_id pointing
+// to itself when it had been ordered, so nothing in the row links it to
+// the row that replaced it. product_chain_links records the successor
+// of every such row, found by the most reliable evidence available:
+//   - audit: the product.update event with the old ID in its changes
+//   - time: the only product of the shop created within seconds after
+//     the old row was deleted, edits did both in one request
+//   - codename: the live product of the shop with the same codename
+//
+// Rows deleted through DeleteProduct have no successor, the rest are
+// reported as unlinked and stay products of their own
+const linkProductChainsSQL = `
+CREATE TABLE product_chain_links (
+	old_id varchar(40) PRIMARY KEY,
+	next_id varchar(40),
+	method varchar(20) NOT NULL
+);
+
+INSERT INTO product_chain_links (old_id, next_id, method)
+SELECT p.id, event.entity_id, 'audit'
+FROM products p
+JOIN LATERAL (
+	SELECT a.entity_id FROM audit_events a
+	WHERE a.action = 'product.update' AND a.entity_type = 'product'
+		AND a.changes->'ID'->>'before' = p.id AND a.entity_id <> p.id
+	ORDER BY a.created_at
+	LIMIT 1
+) event ON true
+WHERE p.base_product_id IS NOT NULL;
+
+INSERT INTO product_chain_links (old_id, next_id, method)
+SELECT p.id, NULL, 'deleted'
+FROM products p
+WHERE p.base_product_id IS NOT NULL
+	AND EXISTS (SELECT 1 FROM audit_events a WHERE a.action = 'product.delete' AND a.entity_id = p.id)
+ON CONFLICT DO NOTHING;
+
+INSERT INTO product_chain_links (old_id, next_id, method)
+SELECT p.id, (array_agg(n.id))[1], 'time'
+FROM products p
+JOIN products n ON n.shop_id = p.shop_id AND n.id <> p.id
+	AND n.created_at >= p.deleted_at AND n.created_at < p.deleted_at + interval '5 seconds'
+WHERE p.base_product_id IS NOT NULL AND p.deleted_at IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM product_chain_links l WHERE l.old_id = p.id)
+GROUP BY p.id
+HAVING count(*) = 1;
+
+INSERT INTO product_chain_links (old_id, next_id, method)
+SELECT p.id, live.id, 'codename'
+FROM products p
+JOIN LATERAL (
+	SELECT l.id FROM products l
+	WHERE l.base_product_id IS NULL AND l.deleted_at IS NULL
+		AND l.shop_id = p.shop_id AND l.codename = p.codename
+	ORDER BY l.created_at DESC
+	LIMIT 1
+) live ON true
+WHERE p.base_product_id IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM product_chain_links l WHERE l.old_id = p.id);
+
+INSERT INTO product_chain_links (old_id, next_id, method)
+SELECT p.id, NULL, 'unlinked'
+FROM products p
+WHERE p.base_product_id IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM product_chain_links l WHERE l.old_id = p.id);
+`
+
+// collapseProductChainsSQL follows the links to the product every row
+// becomes, turns the rows into its revisions and moves their orders to it
+const collapseProductChainsSQL = `
+CREATE TEMP TABLE product_chain ON COMMIT DROP AS
+WITH RECURSIVE chain (old_id, product_id, depth) AS (
+	SELECT id, id, 0 FROM products
+	UNION ALL
+	SELECT c.old_id, l.next_id, c.depth + 1
+	FROM chain c JOIN product_chain_links l ON l.old_id = c.product_id
+	WHERE l.next_id IS NOT NULL AND c.depth < 100
+), resolved AS (
+	SELECT DISTINCT ON (old_id) old_id, product_id FROM chain ORDER BY old_id, depth DESC
+)
+SELECT r.old_id, r.product_id,
+	uuid_generate_v4()::text AS revision_id,
+	row_number() OVER (PARTITION BY r.product_id ORDER BY p.created_at, p.id) AS number
+FROM resolved r JOIN products p ON p.id = r.old_id;
+
+INSERT INTO product_revisions (id, created_at, product_id, number, name, description, image, price, unit, step, priced_by_weight)
+SELECT c.revision_id, p.created_at, c.product_id, c.number, p.name, COALESCE(p.description, ''), COALESCE(p.image, ''), p.price, p.unit, p.step, p.priced_by_weight
+FROM product_chain c JOIN products p ON p.id = c.old_id;
+
+UPDATE ordered_products SET product_id = c.product_id, revision_id = c.revision_id
+FROM product_chain c WHERE ordered_products.product_id = c.old_id;
+
+UPDATE product_variants SET product_id = c.product_id, deleted_at = COALESCE(product_variants.deleted_at, now())
+FROM product_chain c WHERE product_variants.product_id = c.old_id AND c.old_id <> c.product_id;
+
+DELETE FROM bundle_items USING product_chain c WHERE bundle_items.bundle_id = c.old_id AND c.old_id <> c.product_id;
+DELETE FROM product_categories USING product_chain c WHERE product_categories.product_id = c.old_id AND c.old_id <> c.product_id;
+DELETE FROM products USING product_chain c WHERE products.id = c.old_id AND c.old_id <> c.product_id;
+
+UPDATE products SET revision_id = latest.revision_id
+FROM (SELECT DISTINCT ON (product_id) product_id, revision_id FROM product_chain ORDER BY product_id, number DESC) latest
+WHERE products.id = latest.product_id;
+`
+
+// ============================= Helpers =============================
+
+// MigrateProductRevisions collapses the copy chains products had before
+// revisions. It runs once, product_chain_links is kept as its record.
+// base_product_id is only dropped after the unlinked rows were looked
+// at, by starting the API with DROP_BASE_PRODUCT_ID=true
+func MigrateProductRevisions(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Product{}, "base_product_id") {
+		return nil
+	}
+
+	if db.Migrator().HasTable("product_chain_links") {
+		if os.Getenv("DROP_BASE_PRODUCT_ID") != "true" {
+			return nil
+		}
+
+		return db.Exec("ALTER TABLE products DROP COLUMN base_product_id").Error
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(linkProductChainsSQL).Error; err != nil {
+			return err
+		}
+
+		return tx.Exec(collapseProductChainsSQL).Error
+	})
+
+	if err != nil {
+		return fmt.Errorf("product revisions migration failed: %v", err)
+	}
+
+	ReportUnlinkedProducts(db)
+	return nil
+}
+
+// ReportUnlinkedProducts logs the old product rows the migration could
+// not link to the product that replaced them
+func ReportUnlinkedProducts(db *gorm.DB) {
+	var unlinked []struct {
+		ID       string
+		ShopID   string
+		Codename string
+	}
+
+	db.Table("product_chain_links").Select("products.id, products.shop_id, products.codename").
+		Joins("JOIN products ON products.id = product_chain_links.old_id").
+		Where("product_chain_links.method = ?", "unlinked").Scan(&unlinked)
+
+	for _, product := range unlinked {
+		log.Printf("product revisions migration: %s (%s, shop %s) was not linked to a live product", product.ID, product.Codename, product.ShopID)
+	}
+}
+
+// CreateRevision snapshots the product's current values as its next revision
+func CreateRevision(tx *gorm.DB, product *Product) error {
+	var number int
+	if err := tx.Model(&ProductRevision{}).Select("COALESCE(MAX(number), 0)").Where("product_id = ?", product.ID).Scan(&number).Error; err != nil {
+		return err
+	}
+
+	revision := ProductRevision{
+		ProductID:      product.ID,
+		Number:         number + 1,
+		Image:          product.Image,
+		Price:          product.Price,
+		Unit:           product.Unit,
+		Step:           ProductStep(*product),
+		PricedByWeight: product.PricedByWeight,
+	}
+
+	if product.Name != nil {
+		revision.Name = *product.Name
+	}
+
+	if product.Description != nil {
+		revision.Description = *product.Description
+	}
+
+	if err := tx.Create(&revision).Error; err != nil {
+		return err
+	}
+
+	product.RevisionID = &revision.ID
+	return tx.Model(product).Update("revision_id", revision.ID).Error
+}
+
+// RemoveProduct deletes a product. Ordered products and products with
+// stock movements are only soft deleted, their revisions and variants
+// stay for the orders and the inventory ledger
+func RemoveProduct(tx *gorm.DB, product Product) error {
+	if ProductIsOrdered(tx, product.ID) || tx.Take(&InventoryMovement{}, "product_id = ?", product.ID).Error == nil {
+		if err := tx.Model(&product).Update("public", false).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&product).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("product_id = ?", product.ID).Delete(&ProductVariant{}).Error
+	}
+
+	if err := tx.Exec("DELETE FROM product_categories WHERE product_id = ?", product.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().Where("product_id = ?", product.ID).Delete(&ProductVariant{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("bundle_id = ?", product.ID).Delete(&BundleItem{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("product_id = ?", product.ID).Delete(&ProductRevision{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Delete(&product).Error
+}
+
+// PreloadOrderedProducts loads the ordered products of an association
+// with the revisions and variants that were bought
+func PreloadOrderedProducts(tx *gorm.DB, association string) {
+	unscoped := func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped()
+	}
+
+	tx.Preload(association).Preload(association + ".Revision")
+	tx.Preload(association+".Variant", unscoped).Preload(association+".Product", unscoped)
+}
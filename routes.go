@@ -16,27 +16,70 @@ func (a *app) InitRouter() *app {
 	r.PathPrefix("/images/").Handler(http.FileServer(http.Dir(".")))
 
 	r.HandleFunc("/", LandingPage)
+	r.HandleFunc("/.well-known/jwks.json", GetJWKS).Methods("GET")
 	// ========================== Auth ==============================
-	r.HandleFunc("/login", Login).Methods("POST")            // Tested
-	r.HandleFunc("/logout", Logout).Methods("POST")          // -
-	r.HandleFunc("/register", CreateAccount).Methods("POST") // Tested
-	r.HandleFunc("/checkmail", CheckEmail).Methods("POST")   // -
-	r.HandleFunc("/refresh", RefreshTokens).Methods("POST")  // -
+	r.HandleFunc("/login", Login).Methods("POST")                                 // Tested
+	r.HandleFunc("/logout", Logout).Methods("POST")                               // -
+	r.HandleFunc("/register", CreateAccount).Methods("POST")                      // Tested
+	r.HandleFunc("/checkmail", CheckEmail).Methods("POST")                        // -
+	r.HandleFunc("/refresh", RefreshTokens).Methods("POST")                       // -
+	r.HandleFunc("/login/2fa", LoginTwoFactor).Methods("POST")                    // -
+	r.HandleFunc("/claim", StartAccountClaim).Methods("POST")                     // -
+	r.HandleFunc("/claim/confirm", ConfirmAccountClaim).Methods("POST")           // -
+	r.HandleFunc("/password-reset/confirm", ConfirmPasswordReset).Methods("POST") // -
+	r.HandleFunc("/oidc/{provider}/login", OidcLogin).Methods("GET")              // Tested
+	r.HandleFunc("/oidc/{provider}/callback", OidcCallback).Methods("GET")        // -
+
+	// ========================== Profile ==============================
+	r.HandleFunc("/me", isAuthorized(GetMe)).Methods("GET")                             // -
+	r.HandleFunc("/me", isAuthorized(UpdateMe)).Methods("PUT")                          // Tested
+	r.HandleFunc("/me/email/confirm", isAuthorized(ConfirmEmailChange)).Methods("POST") // -
+	r.HandleFunc("/me/reauth", isAuthorized(StartReauthentication)).Methods("POST")     // -
+	r.HandleFunc("/me/export", isAuthorized(ExportMyData)).Methods("GET")               // -
+	r.HandleFunc("/me/deletion", isAuthorized(RequestAccountDeletion)).Methods("POST")  // -
+	r.HandleFunc("/me/deletion", isAuthorized(CancelAccountDeletion)).Methods("DELETE") // -
+
+	// ========================== Two factor ==============================
+	r.HandleFunc("/2fa/enroll", isAuthorized(EnrollTwoFactor)).Methods("POST")                     // -
+	r.HandleFunc("/2fa/confirm", isAuthorized(ConfirmTwoFactor)).Methods("POST")                   // -
+	r.HandleFunc("/2fa", isAuthorized(DisableTwoFactor)).Methods("DELETE")                         // -
+	r.HandleFunc("/admin/2fa", isAuthorized(isAdmin(GetTwoFactorPolicies))).Methods("GET")         // -
+	r.HandleFunc("/admin/2fa/{role}", isAuthorized(isAdmin(UpdateTwoFactorPolicy))).Methods("PUT") // -
+
+	// ========================== Admin ==============================
+	r.HandleFunc("/admin/users", isAuthorized(isAdmin(GetUsers))).Methods("GET")                                // Tested
+	r.HandleFunc("/admin/users/{id}", isAuthorized(isAdmin(GetUser))).Methods("GET")                            // -
+	r.HandleFunc("/admin/users/{id}/unlock", isAuthorized(isAdmin(UnlockUser))).Methods("PUT")                  // -
+	r.HandleFunc("/admin/users/{id}/suspend", isAuthorized(isAdmin(SuspendUser))).Methods("PUT")                // -
+	r.HandleFunc("/admin/users/{id}/unsuspend", isAuthorized(isAdmin(UnsuspendUser))).Methods("PUT")            // -
+	r.HandleFunc("/admin/users/{id}/password-reset", isAuthorized(isAdmin(ForcePasswordReset))).Methods("POST") // -
+	r.HandleFunc("/admin/users/{id}/courier", isAuthorized(isAdmin(PromoteToCourier))).Methods("PUT")           // -
+	r.HandleFunc("/admin/audit", isAuthorized(isAdmin(GetAuditEvents))).Methods("GET")                          // Tested
 
 	// ========================== Shops ==============================
-	r.HandleFunc("/shops", GetShops).Methods("GET")                                    // -
-	r.HandleFunc("/shop/orders", isAuthorized(isFarmer(GetShopOrders))).Methods("GET") // ?
-	r.HandleFunc("/shop/orders/{id}", isAuthorized(EditShopOrder)).Methods("PUT")      // ?
-	r.HandleFunc("/shop/{shop}", GetShop).Methods("GET")                               // ?
-	r.HandleFunc("/shops", isAuthorized(isFarmer(CreateShop))).Methods("POST")         // Tested
-	r.HandleFunc("/shop", isAuthorized(isFarmer(UpdateShop))).Methods("PUT")           // Tested
+	r.HandleFunc("/shops", GetShops).Methods("GET")                                                              // -
+	r.HandleFunc("/shop/orders", isAuthorizedWithKey("orders:read", isFarmer(GetShopOrders))).Methods("GET")     // ?
+	r.HandleFunc("/shop/orders/{id}", isAuthorized(EditShopOrder)).Methods("PUT")                                // ?
+	r.HandleFunc("/shop/keys", isAuthorized(isFarmer(GetApiKeys))).Methods("GET")                                // -
+	r.HandleFunc("/shop/keys", isAuthorized(isFarmer(CreateApiKey))).Methods("POST")                             // Tested
+	r.HandleFunc("/shop/keys/{id}", isAuthorized(isFarmer(DeleteApiKey))).Methods("DELETE")                      // -
+	r.HandleFunc("/shop/inventory", isAuthorizedWithKey("products:read", isFarmer(GetInventory))).Methods("GET") // -
+	r.HandleFunc("/shop/plans", isAuthorized(isFarmer(SavePlan))).Methods("POST")                                // -
+	r.HandleFunc("/shop/plans/{id}", isAuthorized(isFarmer(SavePlan))).Methods("PUT")                            // -
+	r.HandleFunc("/shop/{shop}", GetShop).Methods("GET")                                                         // ?
+	r.HandleFunc("/shop/{shop}/plans", GetShopPlans).Methods("GET")                                              // -
+	r.HandleFunc("/shops", isAuthorized(isFarmer(CreateShop))).Methods("POST")                                   // Tested
+	r.HandleFunc("/shop", isAuthorized(isFarmer(UpdateShop))).Methods("PUT")                                     // Tested
 
 	// ========================== Products ==============================
-	r.HandleFunc("/products", WithContext(GetProducts)).Methods("GET")                                // -
-	r.HandleFunc("/product/{product}", WithContext(GetProduct)).Methods("GET")                        // Tested
-	r.HandleFunc("/products", isAuthorized(AddEditProduct)).Methods("POST")                           // Tested
-	r.HandleFunc("/product/{product}", isAuthorized(isProductOwner(AddEditProduct))).Methods("PUT")   // Tested
-	r.HandleFunc("/product/{product}", isAuthorized(isProductOwner(DeleteProduct))).Methods("DELETE") // ?
+	r.HandleFunc("/products", WithContext(GetProducts)).Methods("GET")                                                         // -
+	r.HandleFunc("/product/{product}", WithContext(GetProduct)).Methods("GET")                                                 // Tested
+	r.HandleFunc("/products", isAuthorizedWithKey("products:write", AddEditProduct)).Methods("POST")                           // Tested
+	r.HandleFunc("/product/{product}", isAuthorizedWithKey("products:write", isProductOwner(AddEditProduct))).Methods("PUT")   // Tested
+	r.HandleFunc("/product/{product}", isAuthorizedWithKey("products:write", isProductOwner(DeleteProduct))).Methods("DELETE") // ?
+	r.HandleFunc("/shop/products", isAuthorizedWithKey("products:write", isFarmer(UpdateStock))).Methods("PATCH")              // -
+	r.HandleFunc("/shop/products/import", isAuthorizedWithKey("products:write", isFarmer(ImportProducts))).Methods("POST")     // -
+	r.HandleFunc("/shop/products/export", isAuthorizedWithKey("products:read", isFarmer(ExportProducts))).Methods("GET")       // -
 
 	// ========================== Categories ==============================
 	r.HandleFunc("/categories", GetCategories).Methods("GET")                                       // - know admin middleware works
@@ -46,10 +89,18 @@ func (a *app) InitRouter() *app {
 	r.HandleFunc("/category/{categoryid}", isAuthorized(isAdmin(DeleteCategory))).Methods("DELETE") // -
 
 	// ========================== Orders ==============================
-	r.HandleFunc("/orders", PlaceOrder).Methods("POST")                                      // TBD BUTINA
-	r.HandleFunc("/orders/{ordernumber}", isAuthorized(ChangeOrder)).Methods("PUT") // TBD
-	r.HandleFunc("/orders/{ordernumber}/cancel", isAuthorized(CancelOrder)).Methods("PUT")   // TBD
-	r.HandleFunc("/orders", isAuthorized(GetOrders)).Methods("GET")                          // -
+	r.HandleFunc("/orders", PlaceOrder).Methods("POST")                                               // TBD BUTINA
+	r.HandleFunc("/orders/{ordernumber}", isAuthorized(isAdminOrCourier(ChangeOrder))).Methods("PUT") // TBD
+	r.HandleFunc("/orders/{ordernumber}/cancel", isAuthorized(CancelOrder)).Methods("PUT")            // TBD
+	r.HandleFunc("/orders", isAuthorized(GetOrders)).Methods("GET")                                   // -
+
+	// Subscriptions
+	r.HandleFunc("/subscriptions", isAuthorized(GetSubscriptions)).Methods("GET")               // -
+	r.HandleFunc("/subscriptions", isAuthorized(Subscribe)).Methods("POST")                     // -
+	r.HandleFunc("/subscriptions/{id}/pause", isAuthorized(PauseSubscription)).Methods("PUT")   // -
+	r.HandleFunc("/subscriptions/{id}/resume", isAuthorized(ResumeSubscription)).Methods("PUT") // -
+	r.HandleFunc("/subscriptions/{id}/skip", isAuthorized(SkipSubscription)).Methods("PUT")     // -
+	r.HandleFunc("/subscriptions/{id}/cancel", isAuthorized(CancelSubscription)).Methods("PUT") // -
 
 	// ========================== Couriers ==============================
 	r.HandleFunc("/couriers", isAuthorized(isAdmin(GetCouriers))).Methods("GET")               // Tested
@@ -63,7 +114,7 @@ func (a *app) InitRouter() *app {
 func (a *app) Start() {
 	// CORS policy
 	credentials := handlers.AllowCredentials()
-	methods := handlers.AllowedMethods([]string{"POST", "GET", "PUT", "DELETE"})
+	methods := handlers.AllowedMethods([]string{"POST", "GET", "PUT", "PATCH", "DELETE"})
 
 	corsUrls := strings.Split(os.Getenv("CORS_ALLOWED_URLS"), ",")
 	origins := handlers.AllowedOrigins(corsUrls)
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm/clause"
+)
+
+const maxSearchTerms = 10
+const snippetWords = 30
+
+type ProductHighlights struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type ProductSearchResult struct {
+	Product
+	Highlights ProductHighlights `json:"highlights"`
+}
+
+// The search vector combines columns of several tables, so it can not
+// be a generated column. RefreshProductSearch keeps it up to date
+const productSearchSetupSQL = `
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector;
+CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING gin(search_vector);
+`
+
+// ============================= Helpers =============================
+
+// FoldLithuanian lowercases s and replaces Lithuanian letters the same
+// way codenames do, "Sūris" becomes "suris"
+func FoldLithuanian(s string) string {
+	folded := strings.ToLower(s)
+
+	for ltLetter, enLetter := range enLtLetterMap {
+		folded = strings.ReplaceAll(folded, ltLetter, enLetter)
+	}
+
+	return folded
+}
+
+// FoldSQL is FoldLithuanian for a SQL expression
+func FoldSQL(expression string) string {
+	ltLetters := make([]string, 0, len(enLtLetterMap))
+	for ltLetter := range enLtLetterMap {
+		ltLetters = append(ltLetters, ltLetter)
+	}
+
+	sort.Strings(ltLetters)
+
+	enLetters := make([]string, 0, len(ltLetters))
+	for _, ltLetter := range ltLetters {
+		enLetters = append(enLetters, enLtLetterMap[ltLetter])
+	}
+
+	return fmt.Sprintf("translate(lower(%s), '%s', '%s')", expression, strings.Join(ltLetters, ""), strings.Join(enLetters, ""))
+}
+
+// productSearchVectorSQL weights the product name highest, then the shop
+// and category names and finally the description
+func productSearchVectorSQL() string {
+	shopName := "(SELECT shops.name FROM shops WHERE shops.id = products.shop_id)"
+	categoryNames := `(SELECT string_agg(categories.name, ' ') FROM categories
+		JOIN product_categories ON product_categories.category_id = categories.id
+		WHERE product_categories.product_id = products.id)`
+
+	weighted := func(expression string, weight string) string {
+		return fmt.Sprintf("setweight(to_tsvector('simple', %s), '%s')", FoldSQL("coalesce("+expression+", '')"), weight)
+	}
+
+	return strings.Join([]string{
+		weighted("products.name", "A"),
+		weighted(shopName, "B"),
+		weighted(categoryNames, "B"),
+		weighted("products.description", "C"),
+	}, " || ")
+}
+
+// RefreshProductSearch rebuilds the search vector of products matching the condition
+func RefreshProductSearch(condition string, args ...interface{}) {
+	db.Exec("UPDATE products SET search_vector = "+productSearchVectorSQL()+" WHERE "+condition, args...)
+}
+
+// SearchTerms splits a search query into folded words
+func SearchTerms(query string) []string {
+	words := strings.FieldsFunc(FoldLithuanian(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	seen := make(map[string]bool)
+
+	for _, word := range words {
+		if seen[word] || len(terms) == maxSearchTerms {
+			continue
+		}
+
+		seen[word] = true
+		terms = append(terms, word)
+	}
+
+	return terms
+}
+
+// SearchTSQuery matches every term as a prefix, the terms only contain
+// letters and digits so they are safe to pass to to_tsquery
+func SearchTSQuery(terms []string) string {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		parts = append(parts, term+":*")
+	}
+
+	return strings.Join(parts, " & ")
+}
+
+// SearchRank ranks full text matches and boosts products whose name
+// equals or starts with the query
+func SearchRank(terms []string) clause.Expr {
+	name := FoldSQL("coalesce(products.name, '')")
+	phrase := strings.Join(terms, " ")
+
+	return clause.Expr{
+		SQL: fmt.Sprintf("ts_rank(products.search_vector, to_tsquery('simple', ?)) + "+
+			"CASE WHEN %[1]s = ? THEN 1 WHEN %[1]s LIKE ? THEN 0.5 ELSE 0 END", name),
+		Vars: []interface{}{SearchTSQuery(terms), phrase, phrase + "%"},
+	}
+}
+
+// Highlight wraps words starting with any of the terms in <mark> and
+// cuts long texts to a snippet around the first match. The text is
+// escaped, so the result can be shown as HTML
+func Highlight(text string, terms []string) string {
+	words := strings.Fields(text)
+	first := -1
+
+	for i, word := range words {
+		folded := strings.TrimFunc(FoldLithuanian(word), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		matched := false
+		for _, term := range terms {
+			if strings.HasPrefix(folded, term) {
+				matched = true
+				break
+			}
+		}
+
+		words[i] = html.EscapeString(word)
+		if matched {
+			words[i] = "<mark>" + words[i] + "</mark>"
+
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+
+	if len(words) <= snippetWords {
+		return strings.Join(words, " ")
+	}
+
+	start := 0
+	if first > snippetWords/3 {
+		start = first - snippetWords/3
+	}
+
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+
+	snippet := strings.Join(words[start:end], " ")
+	if start > 0 {
+		snippet = "… " + snippet
+	}
+
+	if end < len(words) {
+		snippet += " …"
+	}
+
+	return snippet
+}
+
+func NewProductSearchResults(products []Product, terms []string) []ProductSearchResult {
+	results := make([]ProductSearchResult, 0, len(products))
+
+	for _, product := range products {
+		result := ProductSearchResult{Product: product}
+
+		if product.Name != nil {
+			result.Highlights.Name = Highlight(*product.Name, terms)
+		}
+
+		if product.Description != nil {
+			result.Highlights.Description = Highlight(*product.Description, terms)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	terms := SearchTerms("Sūris, ŠVIEŽIAS sūris & pienas:*")
+
+	expected := []string{"suris", "sviezias", "pienas"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("expected %v, got %v", expected, terms)
+	}
+
+	if query := SearchTSQuery(terms); query != "suris:* & sviezias:* & pienas:*" {
+		t.Errorf("unexpected tsquery %s", query)
+	}
+}
+
+func TestFoldSQL(t *testing.T) {
+	expected := "translate(lower(name), 'ąčėęįšūųž', 'aceeisuuz')"
+	if folded := FoldSQL("name"); folded != expected {
+		t.Errorf("expected %s, got %s", expected, folded)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{name: "FoldsLetters", text: "Rūkytas sūris", expected: "Rūkytas <mark>sūris</mark>"},
+		{name: "MatchesPrefix", text: "Surinkta <ūkyje>", expected: "<mark>Surinkta</mark> &lt;ūkyje&gt;"},
+		{name: "NoMatch", text: "Pienas", expected: "Pienas"},
+		{
+			name:     "Snippet",
+			text:     "a b c d e f g h i j k l m n o p q r s t u v w x y z 1 2 3 4 5 6 7 8 9 sūris 10 11",
+			expected: "… z 1 2 3 4 5 6 7 8 9 <mark>sūris</mark> 10 11",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if highlighted := Highlight(c.text, []string{"sur"}); highlighted != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, highlighted)
+			}
+		})
+	}
+}
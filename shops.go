@@ -5,33 +5,118 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+var shopList = listDefinition{
+	Table: "shops",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+		"name":      {Column: "name", Field: "Name"},
+	},
+	DefaultSort: "-createdAt",
+}
+
+var shopOrderList = listDefinition{
+	Table: "shop_orders",
+	Sorts: map[string]sortField{
+		"createdAt": {Column: "created_at", Field: "CreatedAt"},
+		"status":    {Column: "status", Field: "Status"},
+	},
+	DefaultSort: "-createdAt",
+}
+
+// GetShops lists shops page by page. Filters: from and to (creation
+// date), near, radius and type (see ParseGeoFilter). Nearby shops are
+// sorted by distance unless sort is given
 func GetShops(w http.ResponseWriter, r *http.Request) {
-	var shops []Shop
-	db.Order("created_at desc").Find(&shops)
-	JSONResponse(shops, w)
+	shops := make([]Shop, 0)
+
+	createdFilter, err := DateRangeFilter(r, "shops.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	geo, err := ParseGeoFilter(r)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	filters := func(tx *gorm.DB) *gorm.DB {
+		if geo != nil {
+			geo.JoinNearby(tx, "shops.id")
+		}
+
+		return createdFilter(tx)
+	}
+
+	query := db.Preload("Locations")
+	if geo != nil {
+		query.Select("shops.*, nearby.distance")
+	}
+
+	if geo != nil && geo.Near && len(r.URL.Query().Get("sort")) == 0 {
+		query.Order("nearby.distance, shops.id")
+
+		page, err := PaginateByOffset(r, query, &Shop{}, filters, "distance", &shops)
+		PageResponse(w, page, err)
+		return
+	}
+
+	params, err := ParseListParams(r, shopList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	page, err := Paginate(query, &Shop{}, filters, params, &shops)
+	PageResponse(w, page, err)
 }
 
+// GetShopOrders lists the shop's orders page by page. Filters: status
+// (e.g. status=0,1), from and to (creation date)
 func GetShopOrders(w http.ResponseWriter, r *http.Request) {
 	email := GetClaim("email", r)
 
 	var shop Shop
 	GetShopByEmail(*email, &shop, false, "id")
 
-	var shopOrders []ShopOrder
+	shopOrders := make([]ShopOrder, 0)
 
-	tx := db.Preload(clause.Associations).Preload("Order", func(db *gorm.DB) *gorm.DB {
-		return db.Order("pickup_date")
-	}).Preload("OrderedProducts").Preload("OrderedProducts.Product", func(db *gorm.DB) *gorm.DB {
-		return db.Unscoped()
-	})
+	params, err := ParseListParams(r, shopOrderList)
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	statusFilter, err := StatusFilter(r, "shop_orders.status")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
+
+	createdFilter, err := DateRangeFilter(r, "shop_orders.created_at")
+	if err != nil {
+		PageResponse(w, Page{}, err)
+		return
+	}
 
-	tx.Where("shop_id = ?", shop.ID).Find(&shopOrders)
+	filters := func(tx *gorm.DB) *gorm.DB {
+		tx.Where("shop_orders.shop_id = ?", shop.ID)
+		return createdFilter(statusFilter(tx))
+	}
 
-	JSONResponse(shopOrders, w)
+	tx := db.Preload(clause.Associations)
+	PreloadOrderedProducts(tx, "OrderedProducts")
+
+	PreloadHistory(tx, "History")
+
+	page, err := Paginate(tx, &ShopOrder{}, filters, params, &shopOrders)
+	PageResponse(w, page, err)
 }
 
 func EditShopOrder(w http.ResponseWriter, r *http.Request) {
@@ -64,11 +149,15 @@ func EditShopOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := AuditFields(shopOrder)
+
 	request := struct {
 		Status    *int    `json:"status"`
 		Message   *string `json:"message"`
 		Collector *string `json:"collector"`
-	}{nil, nil, nil}
+		// Weighed quantities of items priced by weight, by ordered product ID
+		Weights map[string]decimal.Decimal `json:"weights"`
+	}{nil, nil, nil, nil}
 
 	err := json.NewDecoder(r.Body).Decode(&request)
 
@@ -94,13 +183,30 @@ func EditShopOrder(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(request.Weights) > 0 {
+		if message := ApplyWeights(shopOrder, request.Weights); len(message) > 0 {
+			Response(w, http.StatusBadRequest, message)
+			return
+		}
+	}
+
 	err = db.Save(&shopOrder).Error
 	if err != nil {
 		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
 		return
 	}
 
-	OnShopOrderChange(shopOrder)
+	if len(request.Weights) > 0 {
+		db.Model(&Order{}).Where("id = ?", shopOrder.OrderID).Update("total_price", OrderTotal(shopOrder.OrderID))
+	}
+
+	// The message is overwritten on the shop order, the history keeps all of them
+	if shopOrder.Status != before["Status"] || request.Message != nil {
+		RecordShopOrderStatus(shopOrder.ID, shopOrder.Status, user.ID, shopOrder.Message)
+	}
+
+	WriteAuditChange(r, "shop_order.update", "shop_order", shopOrder.ID, before, shopOrder)
+	OnShopOrderChange(shopOrder, user.ID)
 }
 
 func GetShop(w http.ResponseWriter, r *http.Request) {
@@ -173,6 +279,7 @@ func CreateShop(w http.ResponseWriter, r *http.Request) {
 	db.Save(&user)
 
 	CreateLocations(shop, shop.Locations)
+	WriteAuditChange(r, "shop.create", "shop", shop.ID, nil, shop)
 
 	// Send tokens with correct info
 	MakeTokens(w, user)
@@ -193,6 +300,8 @@ func UpdateShop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := AuditFields(shop)
+
 	var request Shop
 	err = json.NewDecoder(r.Body).Decode(&request)
 
@@ -246,6 +355,12 @@ func UpdateShop(w http.ResponseWriter, r *http.Request) {
 
 	CreateLocations(shop, request.Locations)
 
+	if request.Name != nil {
+		RefreshProductSearch("shop_id = ?", shop.ID)
+	}
+
+	WriteAuditChange(r, "shop.update", "shop", shop.ID, before, shop)
+
 	JSONResponse(&shop, w)
 }
 
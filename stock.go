@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxStockUpdates = 500
+
+var errStockRejected = errors.New("stock update rejected")
+
+// stockUpdate changes one product or variant, quantity sets the stock
+// and delta adds to it
+type stockUpdate struct {
+	Codename  string           `json:"codename"`
+	Variant   string           `json:"variant"`
+	Quantity  *decimal.Decimal `json:"quantity"`
+	Delta     *decimal.Decimal `json:"delta"`
+	Price     *decimal.Decimal `json:"price"`
+	Threshold *decimal.Decimal `json:"lowStockThreshold"`
+}
+
+type StockResult struct {
+	Codename string          `json:"codename"`
+	Variant  string          `json:"variant,omitempty"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Price    decimal.Decimal `json:"price"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// ============================= Handlers =============================
+
+// UpdateStock applies a batch of stock and price changes to the shop's
+// products. Either every update is saved or, when any of them fails,
+// none is and the results tell which ones failed
+func UpdateStock(w http.ResponseWriter, r *http.Request) {
+	var shop Shop
+	if err := GetShopByEmail(*GetClaim("email", r), &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "parduotuvė nerasta")
+		return
+	}
+
+	var updates []stockUpdate
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	if len(updates) == 0 || len(updates) > maxStockUpdates {
+		Response(w, http.StatusBadRequest, fmt.Sprintf("vienu metu galima atnaujinti nuo 1 iki %d produktų", maxStockUpdates))
+		return
+	}
+
+	results := make([]StockResult, len(updates))
+	actorID := RequestActorID(r)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		failed := false
+
+		for i, update := range updates {
+			result, err := ApplyStockUpdate(tx, shop.ID, update, actorID)
+			results[i] = result
+			if err != nil {
+				results[i].Error = err.Error()
+				failed = true
+			}
+		}
+
+		if failed {
+			return errStockRejected
+		}
+
+		return nil
+	})
+
+	if err == errStockRejected {
+		Response(w, http.StatusBadRequest, "produktų atnaujinti nepavyko", results)
+		return
+	}
+
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "įvyko klaida bandant atnaujinti produktus")
+		return
+	}
+
+	WriteAudit(r, "product.stock_update", "shop", shop.ID)
+
+	JSONResponse(results, w)
+}
+
+// ============================= Helpers =============================
+
+// ApplyStockUpdate changes one product within the transaction. The
+// product row stays the same, a price change gets a new revision and
+// a variant's new price a new variant, like AddEditProduct does
+func ApplyStockUpdate(tx *gorm.DB, shopID string, update stockUpdate, actorID string) (StockResult, error) {
+	result := StockResult{Codename: update.Codename, Variant: update.Variant}
+
+	if update.Quantity == nil && update.Delta == nil && update.Price == nil && update.Threshold == nil {
+		return result, errors.New("nenurodyta ką atnaujinti")
+	}
+
+	if update.Price != nil && update.Price.IsNegative() {
+		return result, errors.New("kaina turi būti didesnė už 0")
+	}
+
+	if update.Threshold != nil && update.Threshold.IsNegative() {
+		return result, errors.New("likučio riba negali būti neigiama")
+	}
+
+	var product Product
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Variants").Preload("BundleItems").
+		Take(&product, "codename = ? AND shop_id = ?", update.Codename, shopID).Error
+	if err != nil {
+		return result, errors.New("produkto nepavyko rasti")
+	}
+
+	if len(product.BundleItems) > 0 && (update.Quantity != nil || update.Delta != nil) {
+		return result, errors.New("rinkinio kiekis skaičiuojamas iš jo produktų")
+	}
+
+	if update.Threshold != nil {
+		if err = tx.Model(&product).Update("stock_threshold", *update.Threshold).Error; err != nil {
+			return result, err
+		}
+	}
+
+	result.Quantity, result.Price = product.Quantity, product.Price
+	if update.Quantity == nil && update.Delta == nil && update.Price == nil {
+		return result, nil
+	}
+
+	movement := InventoryMovement{ProductID: product.ID, Reason: movementAdjustment, ActorID: NullableID(actorID)}
+
+	if len(product.Variants) == 0 {
+		if len(update.Variant) > 0 {
+			return result, errors.New("produktas neturi variantų")
+		}
+
+		quantity, err := NextStock(product.Quantity, update)
+		if err != nil {
+			return result, err
+		}
+
+		movement.Change = quantity.Sub(product.Quantity)
+		product.Quantity = quantity
+		if update.Price != nil {
+			product.Price = *update.Price
+		}
+
+		if err = tx.Model(&product).Updates(map[string]interface{}{"quantity": product.Quantity, "price": product.Price}).Error; err != nil {
+			return result, err
+		}
+
+		if err = RecordMovement(tx, movement); err != nil {
+			return result, err
+		}
+
+		if update.Price != nil {
+			err = CreateRevision(tx, &product)
+		}
+
+		result.Quantity, result.Price = product.Quantity, product.Price
+		return result, err
+	}
+
+	variant, ok := FindVariant(product, update.Variant)
+	if !ok {
+		return result, errors.New("produkto varianto nepavyko rasti")
+	}
+
+	quantity, err := NextStock(variant.Quantity, update)
+	if err != nil {
+		return result, err
+	}
+
+	movement.VariantSKU = variant.SKU
+	movement.Change = quantity.Sub(variant.Quantity)
+	variant.Quantity = quantity
+
+	// Ordered products point to the variant they were bought as, so its
+	// price is never changed in place
+	if update.Price != nil && !update.Price.Equal(variant.Price) {
+		if err = tx.Delete(&variant).Error; err != nil {
+			return result, err
+		}
+
+		variant.ID = ""
+		variant.Price = *update.Price
+		err = tx.Create(&variant).Error
+	} else {
+		err = tx.Model(&variant).Update("quantity", variant.Quantity).Error
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	for i := range product.Variants {
+		if product.Variants[i].SKU == variant.SKU {
+			product.Variants[i] = variant
+		}
+	}
+
+	ApplyVariantTotals(&product)
+	if err = tx.Model(&product).Updates(map[string]interface{}{"quantity": product.Quantity, "price": product.Price}).Error; err != nil {
+		return result, err
+	}
+
+	movement.VariantID = &variant.ID
+	if err = RecordMovement(tx, movement); err != nil {
+		return result, err
+	}
+
+	result.Quantity, result.Price = variant.Quantity, variant.Price
+	return result, nil
+}
+
+// NextStock is the stock after the update, it can't go below zero
+func NextStock(current decimal.Decimal, update stockUpdate) (decimal.Decimal, error) {
+	if update.Quantity != nil && update.Delta != nil {
+		return current, errors.New("nurodykite arba kiekį, arba jo pokytį")
+	}
+
+	next := current
+	if update.Quantity != nil {
+		next = *update.Quantity
+	}
+
+	if update.Delta != nil {
+		next = current.Add(*update.Delta)
+	}
+
+	if next.IsNegative() {
+		return current, fmt.Errorf("kiekis negali būti neigiamas, likutis %s", current.String())
+	}
+
+	return next, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestNextStock(t *testing.T) {
+	amount := func(value string) *decimal.Decimal {
+		d := decimal.RequireFromString(value)
+		return &d
+	}
+
+	cases := []struct {
+		name     string
+		update   stockUpdate
+		expected string
+		err      bool
+	}{
+		{name: "Absolute", update: stockUpdate{Quantity: amount("12.5")}, expected: "12.5"},
+		{name: "Delta", update: stockUpdate{Delta: amount("-4")}, expected: "6"},
+		{name: "PriceOnly", update: stockUpdate{Price: amount("3")}, expected: "10"},
+		{name: "BelowZero", update: stockUpdate{Delta: amount("-10.5")}, err: true},
+		{name: "Both", update: stockUpdate{Quantity: amount("1"), Delta: amount("1")}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			next, err := NextStock(decimal.NewFromInt(10), c.update)
+
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+
+			if err != nil || next.String() != c.expected {
+				t.Errorf("expected %s, got %s (%v)", c.expected, next.String(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxPlanFrequency = 90
+
+type planRequest struct {
+	Name        *string                 `json:"name"`
+	Description *string                 `json:"description"`
+	Frequency   *int                    `json:"frequency"`
+	Price       *decimal.Decimal        `json:"price"`
+	Active      *bool                   `json:"active"`
+	Items       *[]SubscriptionPlanItem `json:"items"`
+}
+
+// ============================= Handlers =============================
+
+func GetShopPlans(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	var shop Shop
+	if err := db.Select("id").Take(&shop, "codename = ?", params["shop"]).Error; err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	plans := make([]SubscriptionPlan, 0)
+	db.Preload("Items").Order("created_at").Find(&plans, "shop_id = ? AND active = ?", shop.ID, true)
+
+	JSONResponse(plans, w)
+}
+
+// SavePlan creates a subscription plan, or updates it when the route has an ID
+func SavePlan(w http.ResponseWriter, r *http.Request) {
+	var shop Shop
+	if err := GetShopByEmail(*GetClaim("email", r), &shop, false, "id"); err != nil {
+		Response(w, http.StatusBadRequest, "prieš kuriant prenumeratą privalote susikurti parduotuvę")
+		return
+	}
+
+	var request planRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	planID, isEdit := mux.Vars(r)["id"]
+
+	plan := SubscriptionPlan{ShopID: shop.ID, Active: true}
+	var before map[string]interface{}
+	if isEdit {
+		if err := db.Take(&plan, "id = ? AND shop_id = ?", planID, shop.ID).Error; err != nil {
+			Response(w, http.StatusNotFound, "prenumeratos planas nerastas")
+			return
+		}
+
+		before = AuditFields(plan)
+	}
+
+	if (request.Name != nil && len(*request.Name) == 0) || (!isEdit && request.Name == nil) {
+		Response(w, http.StatusBadRequest, "plano pavadinimas privalomas")
+		return
+	}
+
+	if request.Name != nil {
+		plan.Name = *request.Name
+	}
+
+	if request.Description != nil {
+		plan.Description = *request.Description
+	}
+
+	if (request.Frequency != nil && (*request.Frequency < 1 || *request.Frequency > maxPlanFrequency)) || (!isEdit && request.Frequency == nil) {
+		Response(w, http.StatusBadRequest, fmt.Sprintf("pristatymo dažnumas turi būti nuo 1 iki %d dienų", maxPlanFrequency))
+		return
+	}
+
+	if request.Frequency != nil {
+		plan.Frequency = *request.Frequency
+	}
+
+	if (request.Price != nil && request.Price.LessThan(decimal.Zero)) || (!isEdit && request.Price == nil) {
+		Response(w, http.StatusBadRequest, "kaina turi būti didesnė už 0")
+		return
+	}
+
+	if request.Price != nil {
+		plan.Price = *request.Price
+	}
+
+	if request.Active != nil {
+		plan.Active = *request.Active
+	}
+
+	if !isEdit && (request.Items == nil || len(*request.Items) == 0) {
+		Response(w, http.StatusBadRequest, "plane turi būti bent vienas produktas")
+		return
+	}
+
+	if request.Items != nil {
+		if errors := CheckPlanItems(shop.ID, *request.Items); len(errors) > 0 {
+			Response(w, http.StatusBadRequest, "blogi plano produktai", errors)
+			return
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(&plan).Error; err != nil {
+			return err
+		}
+
+		if request.Items == nil {
+			return nil
+		}
+
+		if err := tx.Where("plan_id = ?", plan.ID).Delete(&SubscriptionPlanItem{}).Error; err != nil {
+			return err
+		}
+
+		plan.Items = *request.Items
+		for i := range plan.Items {
+			plan.Items[i].ID = ""
+			plan.Items[i].PlanID = plan.ID
+		}
+
+		return tx.Create(&plan.Items).Error
+	})
+
+	if err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	if isEdit {
+		WriteAuditChange(r, "subscription_plan.update", "subscription_plan", plan.ID, before, plan)
+	} else {
+		WriteAudit(r, "subscription_plan.create", "subscription_plan", plan.ID)
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	db.Preload("Items").Take(&plan, "id = ?", plan.ID)
+	JSONResponse(plan, w)
+}
+
+func GetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var user User
+	db.Select("id").Take(&user, "email = ?", GetClaim("email", r))
+
+	subscriptions := make([]Subscription, 0)
+	db.Preload("Plan.Items").Preload("Plan.Shop").Preload("Cycles", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("date desc")
+	}).Preload("Cycles.Order").Order("created_at desc").Find(&subscriptions, "user_id = ?", user.ID)
+
+	JSONResponse(subscriptions, w)
+}
+
+// Subscribe starts a subscription, the first box is ordered on the start
+// date (today by default)
+func Subscribe(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Plan        string  `json:"plan"`
+		Address     *string `json:"address"`
+		PaymentType *int    `json:"paymentType"`
+		Note        string  `json:"note"`
+		Start       string  `json:"start"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var plan SubscriptionPlan
+	if err := db.Take(&plan, "id = ? AND active = ?", request.Plan, true).Error; err != nil {
+		Response(w, http.StatusNotFound, "prenumeratos planas nerastas")
+		return
+	}
+
+	if request.Address == nil {
+		Response(w, http.StatusBadRequest, "adresas yra privalomas")
+		return
+	}
+
+	if request.PaymentType == nil {
+		Response(w, http.StatusBadRequest, "mokėjimo informacija yra privaloma")
+		return
+	}
+
+	start := Today()
+	if len(request.Start) > 0 {
+		parsed, err := time.Parse("2006-01-02", request.Start)
+		if err != nil || parsed.Before(start) {
+			Response(w, http.StatusBadRequest, "pradžios data turi būti ne ankstesnė nei šiandien")
+			return
+		}
+
+		start = parsed
+	}
+
+	var user User
+	db.Select("id").Take(&user, "email = ?", GetClaim("email", r))
+
+	subscription := Subscription{
+		PlanID:       plan.ID,
+		UserID:       user.ID,
+		Status:       1,
+		Address:      *request.Address,
+		PaymentType:  *request.PaymentType,
+		Note:         request.Note,
+		NextDelivery: start,
+	}
+
+	if err := db.Create(&subscription).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	subscription.Plan = plan
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(subscription, w)
+}
+
+// PauseSubscription stops ordering until the subscription is resumed, or
+// until the optional until date
+func PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Until string `json:"until"`
+	}{}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	subscription, ok := TakeSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	subscription.Status = 2
+	subscription.PausedUntil = nil
+
+	if len(request.Until) > 0 {
+		until, err := time.Parse("2006-01-02", request.Until)
+		if err != nil || !until.After(Today()) {
+			Response(w, http.StatusBadRequest, "pauzės pabaiga turi būti vėlesnė nei šiandien")
+			return
+		}
+
+		subscription.PausedUntil = &until
+	}
+
+	db.Omit(clause.Associations).Save(&subscription)
+	JSONResponse(subscription, w)
+}
+
+func ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := TakeSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	ResumeAt(&subscription, Today())
+	db.Omit(clause.Associations).Save(&subscription)
+	JSONResponse(subscription, w)
+}
+
+// SkipSubscription skips the next delivery
+func SkipSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := TakeSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	cycle := SubscriptionCycle{SubscriptionID: subscription.ID, Date: subscription.NextDelivery, Skipped: true}
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&cycle)
+
+	subscription.NextDelivery = subscription.NextDelivery.AddDate(0, 0, subscription.Plan.Frequency)
+	db.Omit(clause.Associations).Save(&subscription)
+	JSONResponse(subscription, w)
+}
+
+func CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := TakeSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	subscription.Status = 3
+	db.Omit(clause.Associations).Save(&subscription)
+	JSONResponse(subscription, w)
+}
+
+// ============================= Helpers =============================
+
+// TakeSubscription loads the current user's subscription from the route,
+// cancelled subscriptions can not be changed
+func TakeSubscription(w http.ResponseWriter, r *http.Request) (Subscription, bool) {
+	var user User
+	db.Select("id").Take(&user, "email = ?", GetClaim("email", r))
+
+	var subscription Subscription
+	err := db.Preload("Plan").Take(&subscription, "id = ? AND user_id = ? AND status <> ?", mux.Vars(r)["id"], user.ID, 3).Error
+	if err != nil {
+		Response(w, http.StatusNotFound, "prenumerata nerasta")
+		return subscription, false
+	}
+
+	return subscription, true
+}
+
+// CheckPlanItems makes sure the plan's products belong to the shop and
+// that the quantities can be ordered. Errors are keyed by product codename
+func CheckPlanItems(shopID string, items []SubscriptionPlanItem) map[string]string {
+	errors := make(map[string]string)
+
+	for _, item := range items {
+		var product Product
+		err := db.Preload("Variants").Take(&product, "codename = ? AND shop_id = ?", item.ProductCodename, shopID).Error
+		if err != nil {
+			errors[item.ProductCodename] = "produkto nepavyko rasti"
+			continue
+		}
+
+		if len(product.Variants) > 0 {
+			if _, ok := FindVariant(product, item.VariantSKU); !ok {
+				errors[item.ProductCodename] = "produkto varianto nepavyko rasti"
+				continue
+			}
+		}
+
+		if err = ValidateQuantity(item.Quantity, ProductStep(product)); err != nil {
+			errors[item.ProductCodename] = err.Error()
+		}
+	}
+
+	return errors
+}
+
+// Today is the current date at midnight UTC, the way date columns are read
+func Today() time.Time {
+	year, month, day := time.Now().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// CurrentCycle is the latest cycle date on or before today. Cycles missed
+// while the scheduler was not running are not ordered afterwards
+func CurrentCycle(next time.Time, frequency int, today time.Time) time.Time {
+	if frequency < 1 {
+		frequency = 1
+	}
+
+	cycle := next
+	for !cycle.AddDate(0, 0, frequency).After(today) {
+		cycle = cycle.AddDate(0, 0, frequency)
+	}
+
+	return cycle
+}
+
+// ResumeAt makes the subscription active again from the first cycle on or after the date
+func ResumeAt(subscription *Subscription, date time.Time) {
+	subscription.Status = 1
+	subscription.PausedUntil = nil
+
+	if subscription.NextDelivery.Before(date) {
+		cycle := CurrentCycle(subscription.NextDelivery, subscription.Plan.Frequency, date)
+		if cycle.Before(date) {
+			cycle = cycle.AddDate(0, 0, subscription.Plan.Frequency)
+		}
+
+		subscription.NextDelivery = cycle
+	}
+}
+
+// GenerateSubscriptionOrders orders the boxes of every subscription that
+// is due today
+func GenerateSubscriptionOrders() {
+	today := Today()
+
+	var paused []Subscription
+	db.Preload("Plan").Find(&paused, "status = ? AND paused_until <= ?", 2, today)
+
+	for _, subscription := range paused {
+		ResumeAt(&subscription, today)
+		db.Omit(clause.Associations).Save(&subscription)
+	}
+
+	var due []Subscription
+	db.Preload("Plan.Items").Preload("User").Find(&due, "status = ? AND next_delivery <= ?", 1, today)
+
+	for _, subscription := range due {
+		GenerateSubscriptionOrder(subscription, today)
+	}
+}
+
+// GenerateSubscriptionOrder places the order of the current cycle through
+// the same checks as PlaceOrder. The cycle is claimed first, so running
+// twice for the same cycle never creates a second order
+func GenerateSubscriptionOrder(subscription Subscription, today time.Time) {
+	cycle := SubscriptionCycle{
+		SubscriptionID: subscription.ID,
+		Date:           CurrentCycle(subscription.NextDelivery, subscription.Plan.Frequency, today),
+	}
+
+	if db.Clauses(clause.OnConflict{DoNothing: true}).Create(&cycle).RowsAffected > 0 {
+		if !subscription.Plan.Active {
+			cycle.Error = "prenumeratos planas nebeaktyvus"
+		} else if order, err := CreateSubscriptionOrder(subscription); len(err) > 0 {
+			cycle.Error = err
+		} else {
+			cycle.OrderID = &order.ID
+		}
+
+		db.Save(&cycle)
+	}
+
+	db.Model(&Subscription{}).Where("id = ? AND next_delivery = ?", subscription.ID, subscription.NextDelivery).
+		Update("next_delivery", cycle.Date.AddDate(0, 0, subscription.Plan.Frequency))
+}
+
+// CreateSubscriptionOrder orders the plan's items at the plan's price.
+// Returns the reasons the order could not be placed
+func CreateSubscriptionOrder(subscription Subscription) (Order, string) {
+	requested := make([]OrderedProduct, 0, len(subscription.Plan.Items))
+	for _, item := range subscription.Plan.Items {
+		orderedProduct := OrderedProduct{Product: Product{Codename: item.ProductCodename}, Quantity: item.Quantity}
+		if len(item.VariantSKU) > 0 {
+			orderedProduct.Variant = &ProductVariant{SKU: item.VariantSKU}
+		}
+
+		requested = append(requested, orderedProduct)
+	}
+
+	order, errors, err := SubmitOrder(requested, func(plan orderPlan) (Order, error) {
+		return Order{
+			Email:       subscription.User.Email,
+			Note:        subscription.Note,
+			Address:     subscription.Address,
+			PaymentType: subscription.PaymentType,
+			TotalPrice:  subscription.Plan.Price.Round(2),
+		}, nil
+	})
+
+	if len(errors) > 0 {
+		messages := make([]string, 0, len(errors))
+		for codename, message := range errors {
+			messages = append(messages, codename+": "+message)
+		}
+
+		sort.Strings(messages)
+		return Order{}, strings.Join(messages, "; ")
+	}
+
+	if err != nil {
+		return Order{}, "nepavyko sukurti užsakymo"
+	}
+
+	return order, ""
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentCycle(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2021, 9, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name     string
+		next     time.Time
+		today    time.Time
+		expected time.Time
+	}{
+		{name: "DueToday", next: date(6), today: date(6), expected: date(6)},
+		{name: "DueYesterday", next: date(6), today: date(7), expected: date(6)},
+		{name: "MissedCycles", next: date(6), today: date(21), expected: date(20)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if cycle := CurrentCycle(c.next, 7, c.today); !cycle.Equal(c.expected) {
+				t.Errorf("expected %s, got %s", c.expected, cycle)
+			}
+		})
+	}
+}
+
+func TestResumeAt(t *testing.T) {
+	subscription := Subscription{
+		Status:       2,
+		NextDelivery: time.Date(2021, 9, 6, 0, 0, 0, 0, time.UTC),
+		Plan:         SubscriptionPlan{Frequency: 7},
+	}
+
+	ResumeAt(&subscription, time.Date(2021, 9, 22, 0, 0, 0, 0, time.UTC))
+
+	if subscription.Status != 1 {
+		t.Errorf("expected an active subscription, got status %d", subscription.Status)
+	}
+
+	if expected := time.Date(2021, 9, 27, 0, 0, 0, 0, time.UTC); !subscription.NextDelivery.Equal(expected) {
+		t.Errorf("expected the next delivery on %s, got %s", expected, subscription.NextDelivery)
+	}
+}
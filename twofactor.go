@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+const totpPeriod = 30
+const totpDigits = 6
+const recoveryCodeCount = 10
+
+// =========================== Handlers ===================================
+
+// LoginTwoFactor is the second login step. It accepts the challenge
+// returned by Login, or set as a cookie by OidcCallback, together with
+// a TOTP or recovery code
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	errorMSG := "blogas patvirtinimo kodas"
+
+	request := struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}{"", ""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	if RateLimited(w, "login:ip:"+ClientIP(r), loginIPLimit) {
+		return
+	}
+
+	if cookie, err := r.Cookie(challengeCookie); err == nil && len(request.Challenge) == 0 {
+		request.Challenge = cookie.Value
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := ParseToken(request.Challenge, claims)
+
+	if err != nil || !token.Valid || claims["purpose"] != "2fa" {
+		Response(w, http.StatusUnauthorized, "prisijungimo sesija pasibaigė")
+		return
+	}
+
+	var user User
+	err = db.Take(&user, "email = ? and temporary = ?", claims["email"], false).Error
+	if err != nil || !user.TwoFactorEnabled {
+		Response(w, http.StatusUnauthorized, errorMSG)
+		return
+	}
+
+	if IsLocked(user) {
+		TooManyRequests(w, *user.LockedUntil, "paskyra laikinai užrakinta. bandykite vėliau")
+		return
+	}
+
+	if !UseTOTP(&user, request.Code) && !UseRecoveryCode(user, request.Code) {
+		RegisterFailedLogin(r, user)
+		Response(w, http.StatusUnauthorized, errorMSG)
+		return
+	}
+
+	RegisterSuccessfulLogin(r, user)
+
+	if IsSuspended(user) {
+		Response(w, http.StatusForbidden, "paskyra sustabdyta")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: challengeCookie, Value: "", MaxAge: -1, Path: "/login/2fa"})
+	accessToken, _ := MakeTokens(w, user, true)
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(struct {
+		AccessToken string `json:"accessToken"`
+	}{accessToken}, w)
+}
+
+// EnrollTwoFactor generates a new secret for the user. The secret
+// is only used after it is confirmed with ConfirmTwoFactor
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var user User
+	email := GetClaim("email", r)
+	if err := db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		Response(w, http.StatusConflict, "dviejų veiksnių autentifikavimas jau įjungtas")
+		return
+	}
+
+	user.TwoFactorSecret = GenerateTOTPSecret()
+	if err := db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	JSONResponse(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{user.TwoFactorSecret, ProvisioningURI(user)}, w)
+}
+
+// ConfirmTwoFactor enables two factor authentication once the user
+// proves they can generate codes. Recovery codes are only shown here
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Code string `json:"code"`
+	}{""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var user User
+	email := GetClaim("email", r)
+	if err = db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(user.TwoFactorSecret) == 0 {
+		Response(w, http.StatusBadRequest, "dviejų veiksnių autentifikavimas nepradėtas")
+		return
+	}
+
+	if !UseTOTP(&user, request.Code) {
+		Response(w, http.StatusBadRequest, "blogas patvirtinimo kodas")
+		return
+	}
+
+	user.TwoFactorEnabled = true
+	if err = db.Save(&user).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	codes := GenerateRecoveryCodes(user)
+
+	WriteAudit(r, "user.2fa_enable", "user", user.ID)
+
+	// Enrolling counts as a step-up for the current session
+	MakeTokens(w, user, true)
+
+	JSONResponse(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes}, w)
+}
+
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Code string `json:"code"`
+	}{""}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var user User
+	email := GetClaim("email", r)
+	if err = db.Take(&user, "email = ?", email).Error; err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !user.TwoFactorEnabled || !UseTOTP(&user, request.Code) {
+		Response(w, http.StatusBadRequest, "blogas patvirtinimo kodas")
+		return
+	}
+
+	user.TwoFactorEnabled = false
+	user.TwoFactorSecret = ""
+	db.Save(&user)
+	db.Delete(&RecoveryCode{}, "user_id = ?", user.ID)
+
+	WriteAudit(r, "user.2fa_disable", "user", user.ID)
+	MakeTokens(w, user)
+}
+
+func GetTwoFactorPolicies(w http.ResponseWriter, r *http.Request) {
+	var policies []TwoFactorPolicy
+	db.Find(&policies)
+	JSONResponse(policies, w)
+}
+
+func UpdateTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	role := strings.ToLower(params["role"])
+
+	if role != "a" && role != "f" && role != "c" {
+		Response(w, http.StatusBadRequest, "tokia rolė neegzistuoja")
+		return
+	}
+
+	request := struct {
+		Required *bool `json:"required"`
+	}{nil}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Required == nil {
+		Response(w, http.StatusBadRequest, "blogas duomenų formatas")
+		return
+	}
+
+	var before TwoFactorPolicy
+	db.Take(&before, "role = ?", role)
+
+	policy := TwoFactorPolicy{Role: role, Required: *request.Required}
+	if err = db.Save(&policy).Error; err != nil {
+		Response(w, http.StatusInternalServerError, "klaida saugojant duomenis. bandykite dar kartą")
+		return
+	}
+
+	WriteAuditChange(r, "2fa_policy.update", "2fa_policy", role, before, policy)
+
+	JSONResponse(policy, w)
+}
+
+// ===================================================================
+
+// ============================= Helpers =============================
+
+func GenerateTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps read from a QR code
+func ProvisioningURI(user User) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if len(issuer) == 0 {
+		issuer = "miniGoApi"
+	}
+
+	query := url.Values{}
+	query.Set("secret", user.TwoFactorSecret)
+	query.Set("issuer", issuer)
+	query.Set("period", fmt.Sprint(totpPeriod))
+	query.Set("digits", fmt.Sprint(totpDigits))
+
+	label := url.PathEscape(issuer + ":" + user.Name)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// GenerateTOTP computes a RFC 6238 code for the given time
+func GenerateTOTP(secret string, t time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/totpPeriod))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// ValidateTOTP accepts codes from the previous, current and next period
+// to allow for clock drift, but only from periods after lastStep.
+// Returns the period of the code
+func ValidateTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	if len(secret) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+
+	for _, drift := range []int{-1, 0, 1} {
+		at := t.Add(time.Duration(drift*totpPeriod) * time.Second)
+		step := at.Unix() / totpPeriod
+
+		expected, err := GenerateTOTP(secret, at)
+		if err == nil && step > lastStep && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// UseTOTP checks the user's code and records its period, so the same
+// code can't be used again, even by concurrent requests
+func UseTOTP(user *User, code string) bool {
+	step, ok := ValidateTOTP(user.TwoFactorSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+
+	result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	user.TOTPLastStep = step
+	return true
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes and
+// returns the new ones in plain text. Only hashes are stored
+func GenerateRecoveryCodes(user User) []string {
+	db.Delete(&RecoveryCode{}, "user_id = ?", user.ID)
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ReplaceAll(GenerateSalt(), "-", "")[0:10]
+		codes = append(codes, code)
+
+		db.Create(&RecoveryCode{
+			UserID: user.ID,
+			Code:   GenerateSecurePassword(code, user.Salt),
+		})
+	}
+
+	return codes
+}
+
+// UseRecoveryCode marks a matching unused recovery code as used
+func UseRecoveryCode(user User, code string) bool {
+	if len(code) == 0 {
+		return false
+	}
+
+	hashed := GenerateSecurePassword(strings.TrimSpace(code), user.Salt)
+
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code = ? AND used_at IS NULL", user.ID, hashed).
+		Update("used_at", time.Now())
+
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// TwoFactorRequired reports whether any of the roles in permissions
+// has two factor authentication enforced by an admin
+func TwoFactorRequired(permissions string) bool {
+	roles := strings.Split(strings.ToLower(permissions), "")
+	if len(permissions) == 0 {
+		return false
+	}
+
+	err := db.Take(&TwoFactorPolicy{}, "role IN ? AND required = ?", roles, true).Error
+	return err == nil
+}
+
+// GenerateChallengeToken returns a short lived token that only
+// LoginTwoFactor accepts
+func GenerateChallengeToken(user User) (string, error) {
+	return GenerateToken(map[string]interface{}{
+		"email":   user.Email,
+		"purpose": "2fa",
+		"exp":     time.Now().Add(time.Minute * 5).Unix(),
+	})
+}
+
+func HasSteppedUp(r *http.Request) bool {
+	mfa := GetClaim("mfa", r)
+	return mfa != nil && *mfa == "true"
+}
+
+// requireStepUp rejects tokens without the mfa claim when the
+// role requires two factor authentication
+func requireStepUp(next http.HandlerFunc, role string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if TwoFactorRequired(role) && !HasSteppedUp(r) {
+			Response(w, http.StatusForbidden, "reikalingas dviejų veiksnių autentifikavimas")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
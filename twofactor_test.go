@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestGenerateTOTP(t *testing.T) {
+	// RFC 6238 test secret "12345678901234567890"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+	}
+
+	for unix, expected := range cases {
+		code, err := GenerateTOTP(secret, time.Unix(unix, 0))
+		if err != nil || code != expected {
+			t.Errorf("at %d expected %s, got %s", unix, expected, code)
+		}
+	}
+
+	step, ok := ValidateTOTP(secret, "287082", time.Unix(59+totpPeriod, 0), 0)
+	if !ok || step != 59/totpPeriod {
+		t.Error("code from the previous period should be accepted")
+	}
+
+	if _, ok = ValidateTOTP(secret, "287082", time.Unix(59+totpPeriod*3, 0), 0); ok {
+		t.Error("old code should be rejected")
+	}
+
+	if _, ok = ValidateTOTP(secret, "287082", time.Unix(59, 0), step); ok {
+		t.Error("used code should be rejected")
+	}
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	app := NewApp().InitRouter().InitDB(".env-test")
+
+	t.Cleanup(func() {
+		app.CloseDbTest()
+	})
+
+	_, accessToken, _ := InitAccount(app, "admin")
+
+	cases := []TestStruct{
+		{
+			name:     "BadChallenge",
+			body:     map[string]interface{}{"challenge": "asd", "code": "123456"},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "AccessTokenIsNotChallenge",
+			body:     map[string]interface{}{"challenge": accessToken, "code": "123456"},
+			expected: http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, _ := json.Marshal(c.body)
+
+			apitest.New(c.name).
+				Handler(app.Router).
+				Post("/login/2fa").JSON(body).
+				Expect(t).
+				Status(c.expected).
+				CookieNotPresent("Access-Token").
+				End()
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Units a product can be sold in: pieces, kilograms, grams, litres,
+// millilitres and dozens
+var productUnits = map[string]bool{"vnt": true, "kg": true, "g": true, "l": true, "ml": true, "tuz": true}
+
+// Money and stock columns used to be created as text, decimal.Decimal
+// is a driver.Valuer returning a string. AutoMigrate can not convert
+// them without a USING clause
+var decimalColumns = map[string][]string{
+	"products":         {"price", "quantity"},
+	"product_variants": {"price", "quantity"},
+	"orders":           {"total_price"},
+	"ordered_products": {"quantity"},
+}
+
+// ============================= Helpers =============================
+
+// MigrateDecimalColumns converts text columns from decimalColumns to
+// numeric, it has to run before AutoMigrate
+func MigrateDecimalColumns(db *gorm.DB) {
+	for table, columns := range decimalColumns {
+		for _, column := range columns {
+			db.Exec(fmt.Sprintf(`DO $$ BEGIN
+				IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = '%[1]s' AND column_name = '%[2]s' AND data_type = 'text') THEN
+					ALTER TABLE %[1]s ALTER COLUMN %[2]s TYPE numeric USING NULLIF(%[2]s, '')::numeric;
+				END IF;
+			END $$`, table, column))
+		}
+	}
+}
+
+// ProductStep is the smallest orderable amount, older products step by one
+func ProductStep(product Product) decimal.Decimal {
+	if product.Step.LessThanOrEqual(decimal.Zero) {
+		return decimal.NewFromInt(1)
+	}
+
+	return product.Step
+}
+
+// ValidateQuantity checks that an ordered quantity is a positive multiple of the step
+func ValidateQuantity(quantity decimal.Decimal, step decimal.Decimal) error {
+	if quantity.LessThanOrEqual(decimal.Zero) {
+		return errors.New("kiekis turi būti didesnis už 0")
+	}
+
+	if !quantity.Mod(step).IsZero() {
+		return fmt.Errorf("kiekis turi būti %s kartotinis", step.String())
+	}
+
+	return nil
+}
+
+// OrderTotal sums the order's lines that are not cancelled at the
+// prices of the revisions bought, bundle components are included in the
+// bundle's price. Lines priced by weight
+// use the weight entered by the farmer once it is known
+func OrderTotal(orderID string) decimal.Decimal {
+	var total decimal.NullDecimal
+
+	db.Unscoped().Table("ordered_products").
+		Select("SUM(COALESCE(product_variants.price, product_revisions.price, products.price) * COALESCE(ordered_products.actual_quantity, ordered_products.quantity))").
+		Joins("join products on products.id = ordered_products.product_id").
+		Joins("left join product_revisions on product_revisions.id = ordered_products.revision_id").
+		Joins("join shop_orders on shop_orders.id = ordered_products.shop_order_id").
+		Joins("left join product_variants on product_variants.id = ordered_products.variant_id").
+		Where("ordered_products.order_id = ? AND ordered_products.bundle_line_id IS NULL AND shop_orders.status <> ?", orderID, 3).
+		Scan(&total)
+
+	return total.Decimal.Round(2)
+}
+
+// ApplyWeights stores the weighed quantities of the shop order's items
+// priced by weight. Returns an error message when a weight can not be set
+func ApplyWeights(shopOrder ShopOrder, weights map[string]decimal.Decimal) string {
+	var order Order
+	db.Take(&order, "id = ?", shopOrder.OrderID)
+
+	if order.Status >= 4 || shopOrder.Status == 3 {
+		return "užsakymo svorių keisti nebegalima"
+	}
+
+	var orderedProducts []OrderedProduct
+	db.Preload("Product", func(tx *gorm.DB) *gorm.DB {
+		return tx.Unscoped()
+	}).Find(&orderedProducts, "shop_order_id = ? AND id IN ?", shopOrder.ID, weightIDs(weights))
+
+	if len(orderedProducts) != len(weights) {
+		return "užsakyme tokių produktų nėra"
+	}
+
+	for _, orderedProduct := range orderedProducts {
+		// Bundle components are not priced on their own
+		if !orderedProduct.Product.PricedByWeight || orderedProduct.BundleLineID != nil {
+			return "produktas parduodamas ne pagal svorį"
+		}
+
+		if !weights[orderedProduct.ID].GreaterThan(decimal.Zero) {
+			return "svoris turi būti didesnis už 0"
+		}
+	}
+
+	for _, orderedProduct := range orderedProducts {
+		db.Model(&orderedProduct).Update("actual_quantity", weights[orderedProduct.ID])
+	}
+
+	return ""
+}
+
+func weightIDs(weights map[string]decimal.Decimal) []string {
+	ids := make([]string, 0, len(weights))
+	for id := range weights {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
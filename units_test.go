@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValidateQuantity(t *testing.T) {
+	cases := []struct {
+		name     string
+		quantity string
+		step     string
+		err      bool
+	}{
+		{name: "WholePieces", quantity: "3", step: "1"},
+		{name: "Kilograms", quantity: "1.5", step: "0.25"},
+		{name: "NotMultipleOfStep", quantity: "1.3", step: "0.25", err: true},
+		{name: "Fractional", quantity: "0.5", step: "1", err: true},
+		{name: "Zero", quantity: "0", step: "1", err: true},
+		{name: "Negative", quantity: "-1", step: "1", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateQuantity(decimal.RequireFromString(c.quantity), decimal.RequireFromString(c.step))
+			if (err != nil) != c.err {
+				t.Errorf("expected error %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestProductStep(t *testing.T) {
+	if !ProductStep(Product{}).Equal(decimal.NewFromInt(1)) {
+		t.Error("products without a step should step by one")
+	}
+
+	if !ProductStep(Product{Step: decimal.NewFromFloat(0.1)}).Equal(decimal.NewFromFloat(0.1)) {
+		t.Error("expected the product's own step")
+	}
+}
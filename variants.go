@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// VariantOptions are the option values telling variants apart,
+// e.g. {"size": "500g"}
+type VariantOptions map[string]string
+
+type variantRequest struct {
+	SKU      string         `json:"sku"`
+	Options  VariantOptions `json:"options"`
+	Price    *float64       `json:"price"`
+	Quantity *float64       `json:"quantity"`
+}
+
+// ============================= Helpers =============================
+
+// ParseVariants reads the variants form value, a JSON array. Variant
+// images are uploaded as variantFile<index>, variants without a new
+// image keep the one of the existing variant with the same SKU
+func ParseVariants(r *http.Request, existing []ProductVariant) ([]ProductVariant, error) {
+	var requests []variantRequest
+	if err := json.Unmarshal([]byte(r.FormValue("variants")), &requests); err != nil {
+		return nil, errors.New("blogas variantų formatas")
+	}
+
+	existingImages := make(map[string]ImagePath)
+	for _, variant := range existing {
+		existingImages[variant.SKU] = variant.Image
+	}
+
+	variants := make([]ProductVariant, 0, len(requests))
+	skus := make(map[string]bool)
+
+	for i, request := range requests {
+		sku := strings.TrimSpace(request.SKU)
+
+		if len(sku) == 0 || len(sku) > 64 {
+			return nil, errors.New("kiekvienas variantas privalo turėti kodą (SKU)")
+		}
+
+		if skus[sku] {
+			return nil, fmt.Errorf("variantų kodai kartojasi: %s", sku)
+		}
+
+		if request.Price == nil || *request.Price < 0 {
+			return nil, fmt.Errorf("varianto %s kaina turi būti didesnė už 0", sku)
+		}
+
+		if request.Quantity == nil || *request.Quantity < 0 {
+			return nil, fmt.Errorf("varianto %s kiekis turi būti didesnis už 0", sku)
+		}
+
+		skus[sku] = true
+
+		image, err := FileUpload(r, "variantFile"+strconv.Itoa(i), "product")
+		if err != nil {
+			return nil, fmt.Errorf("varianto %s paveikslėlis: %s", sku, err.Error())
+		}
+
+		if len(image) == 0 {
+			image = existingImages[sku]
+		}
+
+		variants = append(variants, ProductVariant{
+			SKU:      sku,
+			Options:  request.Options,
+			Price:    decimal.NewFromFloat(*request.Price),
+			Quantity: decimal.NewFromFloat(*request.Quantity),
+			Image:    image,
+		})
+	}
+
+	return variants, nil
+}
+
+// CheckVariantSKUs makes sure SKUs are unique among the shop's current
+// products. excludeProductID is the product being edited
+func CheckVariantSKUs(shopID string, excludeProductID string, variants []ProductVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	skus := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		skus = append(skus, variant.SKU)
+	}
+
+	var taken []string
+	db.Model(&ProductVariant{}).Select("product_variants.sku").
+		Joins("join products on products.id = product_variants.product_id").
+		Where("products.shop_id = ? AND products.id <> ? AND products.deleted_at IS NULL", shopID, excludeProductID).
+		Where("product_variants.sku IN ?", skus).
+		Find(&taken)
+
+	if len(taken) > 0 {
+		return fmt.Errorf("toks variantų kodas jau naudojamas: %s", strings.Join(taken, ", "))
+	}
+
+	return nil
+}
+
+// CopyVariants prepares variants to be created again on a product edit,
+// the originals are soft deleted and stay for the orders pointing to them
+func CopyVariants(variants []ProductVariant) []ProductVariant {
+	copies := make([]ProductVariant, 0, len(variants))
+
+	for _, variant := range variants {
+		variant.ID = ""
+		variant.ProductID = ""
+		copies = append(copies, variant)
+	}
+
+	return copies
+}
+
+// ApplyVariantTotals shows the cheapest variant's price and the total
+// stock on a product with variants
+func ApplyVariantTotals(product *Product) {
+	if len(product.Variants) == 0 {
+		return
+	}
+
+	product.Price = product.Variants[0].Price
+	product.Quantity = decimal.Zero
+
+	for _, variant := range product.Variants {
+		if variant.Price.LessThan(product.Price) {
+			product.Price = variant.Price
+		}
+
+		product.Quantity = product.Quantity.Add(variant.Quantity)
+	}
+}
+
+func FindVariant(product Product, sku string) (ProductVariant, bool) {
+	for _, variant := range product.Variants {
+		if variant.SKU == sku {
+			return variant, true
+		}
+	}
+
+	return ProductVariant{}, false
+}
+
+func (o VariantOptions) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+
+	encoded, err := json.Marshal(o)
+	return string(encoded), err
+}
+
+func (o *VariantOptions) Scan(value interface{}) error {
+	switch typed := value.(type) {
+	case nil:
+		*o = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(typed, o)
+	case string:
+		return json.Unmarshal([]byte(typed), o)
+	}
+
+	return errors.New("unsupported variant options type")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseVariants(t *testing.T) {
+	cases := []struct {
+		name     string
+		variants string
+		err      bool
+	}{
+		{name: "Valid", variants: `[{"sku":"honey-250","options":{"size":"250g"},"price":4.5,"quantity":3},{"sku":"honey-500","price":8,"quantity":0}]`},
+		{name: "BadFormat", variants: `{"sku":"honey-250"}`, err: true},
+		{name: "MissingSKU", variants: `[{"price":4.5,"quantity":3}]`, err: true},
+		{name: "DuplicateSKU", variants: `[{"sku":"a","price":1,"quantity":1},{"sku":"a","price":2,"quantity":1}]`, err: true},
+		{name: "NegativePrice", variants: `[{"sku":"a","price":-1,"quantity":1}]`, err: true},
+		{name: "MissingQuantity", variants: `[{"sku":"a","price":1}]`, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			form := url.Values{"variants": {c.variants}}
+			r := httptest.NewRequest("POST", "/products", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			existing := []ProductVariant{{SKU: "honey-250", Image: "honey.png"}}
+			variants, err := ParseVariants(r, existing)
+
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(variants) != 2 || variants[0].Image != "honey.png" || variants[0].Options["size"] != "250g" {
+				t.Errorf("unexpected variants %+v", variants)
+			}
+		})
+	}
+}
+
+func TestApplyVariantTotals(t *testing.T) {
+	product := Product{Variants: []ProductVariant{
+		{SKU: "a", Price: decimal.NewFromInt(8), Quantity: decimal.NewFromInt(2)},
+		{SKU: "b", Price: decimal.NewFromFloat(4.5), Quantity: decimal.NewFromInt(3)},
+	}}
+
+	ApplyVariantTotals(&product)
+
+	if !product.Price.Equal(decimal.NewFromFloat(4.5)) || !product.Quantity.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("expected price 4.5 and quantity 5, got %s and %s", product.Price, product.Quantity)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Only what catalog import and export need from the XLSX format: the
+// first worksheet is read as text, exports are written as inline strings
+
+var errBadXLSX = errors.New("blogas XLSX failas")
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RelationshipID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxString struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxString `xml:"si"`
+}
+
+type xlsxCell struct {
+	Ref    string     `xml:"r,attr"`
+	Type   string     `xml:"t,attr"`
+	Value  string     `xml:"v"`
+	Inline xlsxString `xml:"is"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Index int        `xml:"r,attr"`
+		Cells []xlsxCell `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func (s xlsxString) String() string {
+	if len(s.Runs) == 0 {
+		return s.Text
+	}
+
+	var text strings.Builder
+	for _, run := range s.Runs {
+		text.WriteString(run.Text)
+	}
+
+	return text.String()
+}
+
+// ReadXLSX returns the rows of the first worksheet, the way a CSV reader would
+func ReadXLSX(data []byte) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errBadXLSX
+	}
+
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	var workbook xlsxWorkbook
+	var relationships xlsxRelationships
+	if err = decodeXLSXPart(files, "xl/workbook.xml", &workbook); err != nil || len(workbook.Sheets) == 0 {
+		return nil, errBadXLSX
+	}
+
+	if err = decodeXLSXPart(files, "xl/_rels/workbook.xml.rels", &relationships); err != nil {
+		return nil, errBadXLSX
+	}
+
+	sheetPath := ""
+	for _, relationship := range relationships.Relationships {
+		if relationship.ID == workbook.Sheets[0].RelationshipID {
+			sheetPath = relationship.Target
+		}
+	}
+
+	if strings.HasPrefix(sheetPath, "/") {
+		sheetPath = strings.TrimPrefix(sheetPath, "/")
+	} else {
+		sheetPath = path.Join("xl", sheetPath)
+	}
+
+	// Workbooks without text cells have no shared strings
+	var sharedStrings xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err = decodeXLSXPart(files, "xl/sharedStrings.xml", &sharedStrings); err != nil {
+			return nil, errBadXLSX
+		}
+	}
+
+	var sheet xlsxSheet
+	if err = decodeXLSXPart(files, sheetPath, &sheet); err != nil {
+		return nil, errBadXLSX
+	}
+
+	var rows [][]string
+	for _, row := range sheet.Rows {
+		// Empty rows are left out of the sheet, keep the row numbers
+		for row.Index > len(rows)+1 {
+			rows = append(rows, nil)
+		}
+
+		var values []string
+		for i, cell := range row.Cells {
+			column := i
+			if len(cell.Ref) > 0 {
+				column = xlsxColumn(cell.Ref)
+			}
+
+			for len(values) < column {
+				values = append(values, "")
+			}
+
+			value := cell.Value
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(sharedStrings.Items) {
+					return nil, errBadXLSX
+				}
+
+				value = sharedStrings.Items[index].String()
+			case "inlineStr":
+				value = cell.Inline.String()
+			case "b":
+				value = map[string]string{"1": "true", "0": "false"}[cell.Value]
+			}
+
+			values = append(values, value)
+		}
+
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+func decodeXLSXPart(files map[string]*zip.File, name string, v interface{}) error {
+	file, ok := files[name]
+	if !ok {
+		return errBadXLSX
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return xml.NewDecoder(reader).Decode(v)
+}
+
+// xlsxColumn turns a cell reference like "AB12" into a zero based column index
+func xlsxColumn(ref string) int {
+	column := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+
+		column = column*26 + int(r-'A'+1)
+	}
+
+	return column - 1
+}
+
+func xlsxColumnName(column int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+
+	return name
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`</Types>`
+
+const xlsxRootRelationships = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbookXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="Produktai" sheetId="1" r:id="rId1"/></sheets>` +
+	`</workbook>`
+
+const xlsxWorkbookRelationships = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`</Relationships>`
+
+// XLSXWriter streams a single worksheet workbook row by row
+type XLSXWriter struct {
+	archive *zip.Writer
+	sheet   io.Writer
+	row     int
+}
+
+func NewXLSXWriter(w io.Writer) (*XLSXWriter, error) {
+	archive := zip.NewWriter(w)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRelationships},
+		{"xl/workbook.xml", xlsxWorkbookXML},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRelationships},
+	}
+
+	for _, part := range parts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = io.WriteString(file, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	return &XLSXWriter{archive: archive, sheet: sheet}, err
+}
+
+func (x *XLSXWriter) WriteRow(values []string) error {
+	x.row++
+
+	var row bytes.Buffer
+	row.WriteString(`<row r="` + strconv.Itoa(x.row) + `">`)
+
+	for i, value := range values {
+		row.WriteString(`<c r="` + xlsxColumnName(i) + strconv.Itoa(x.row) + `" t="inlineStr"><is><t xml:space="preserve">`)
+		if err := xml.EscapeText(&row, []byte(value)); err != nil {
+			return err
+		}
+		row.WriteString(`</t></is></c>`)
+	}
+
+	row.WriteString(`</row>`)
+
+	_, err := x.sheet.Write(row.Bytes())
+	return err
+}
+
+func (x *XLSXWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+
+	return x.archive.Close()
+}
+
+// IsXLSX tells XLSX uploads apart from CSV by the zip signature
+func IsXLSX(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}